@@ -0,0 +1,52 @@
+package macaroons
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+const (
+	// armorType is the type in the header and footer lines of an armored
+	// macaroon.
+	armorType = "MACAROON"
+)
+
+// EncodeArmored serializes the macaroon into a PEM block of type MACAROON,
+// i.e. its base64-encoded binary form wrapped between header and footer lines.
+// This makes it easy to copy and paste, e.g. through email or chat.
+func EncodeArmored(mac *macaroon.Macaroon) ([]byte, error) {
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  armorType,
+		Bytes: macBytes,
+	}), nil
+}
+
+// DecodeArmored decodes a macaroon serialized with EncodeArmored. Surrounding
+// whitespace is ignored, but anything else besides the single armored block
+// is rejected.
+func DecodeArmored(data []byte) (*macaroon.Macaroon, error) {
+	block, rest := pem.Decode(bytes.TrimSpace(data))
+	switch {
+	case block == nil:
+		return nil, fmt.Errorf("no armored macaroon found")
+	case block.Type != armorType:
+		return nil, fmt.Errorf("unexpected armor type %q", block.Type)
+	case len(block.Headers) != 0:
+		return nil, fmt.Errorf("unexpected headers in armored macaroon")
+	case len(rest) != 0:
+		return nil, fmt.Errorf("trailing data after armored macaroon")
+	}
+
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, fmt.Errorf("invalid armored macaroon: %v", err)
+	}
+	return mac, nil
+}
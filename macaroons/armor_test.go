@@ -0,0 +1,61 @@
+package macaroons
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestArmor tests that a macaroon survives a round trip through the armored
+// format, and that corrupted armor is rejected.
+func TestArmor(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	armored, err := EncodeArmored(newMac)
+	if err != nil {
+		t.Fatalf("Error armoring macaroon: %v", err)
+	}
+	if !bytes.HasPrefix(armored, []byte("-----BEGIN MACAROON-----\n")) {
+		t.Fatalf("unexpected armor:\n%s", armored)
+	}
+
+	// Whitespace picked up while copying is fine.
+	decoded, err := DecodeArmored(append([]byte("\n  "), armored...))
+	if err != nil {
+		t.Fatalf("Error decoding armored macaroon: %v", err)
+	}
+	expected, err := newMac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing macaroon: %v", err)
+	}
+	got, err := decoded.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing decoded macaroon: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("decoded macaroon doesn't match original")
+	}
+
+	text := string(armored)
+	lines := strings.Split(text, "\n")
+	corrupted := map[string]string{
+		"empty":        "",
+		"no footer":    strings.Join(lines[:len(lines)-2], "\n"),
+		"wrong type":   strings.Replace(text, "MACAROON", "KEY", 2),
+		"bad base64":   strings.Replace(text, lines[1], "!!!", 1),
+		"bad payload":  strings.Replace(text, lines[1], "AAAA", 1),
+		"trailing":     text + "more",
+		"second block": text + text,
+	}
+	for name, data := range corrupted {
+		if _, err := DecodeArmored([]byte(data)); err == nil {
+			t.Fatalf("%s armor accepted", name)
+		}
+	}
+}
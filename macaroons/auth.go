@@ -4,16 +4,33 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 
 	"gopkg.in/macaroon-bakery.v1/bakery"
-	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
 	macaroon "gopkg.in/macaroon.v1"
 )
 
+const (
+	// MetadataKey is the gRPC metadata key under which the hex-encoded
+	// macaroon is passed along with a request.
+	MetadataKey = "macaroon"
+)
+
+var (
+	// ErrMissingMacaroon is returned when the request metadata doesn't
+	// carry a macaroon under the expected key.
+	ErrMissingMacaroon = fmt.Errorf("no macaroon in request metadata")
+
+	// ErrInvalidMacaroon is returned when the macaroon carried in the
+	// request metadata can't be decoded. The error returned wraps it, so
+	// it should be matched with errors.Is.
+	ErrInvalidMacaroon = fmt.Errorf("invalid macaroon in request metadata")
+)
+
 // MacaroonCredential wraps a macaroon to implement the
 // credentials.PerRPCCredentials interface.
 type MacaroonCredential struct {
@@ -38,7 +55,7 @@ func (m MacaroonCredential) GetRequestMetadata(ctx context.Context,
 	}
 
 	md := make(map[string]string)
-	md["macaroon"] = hex.EncodeToString(macBytes)
+	md[MetadataKey] = hex.EncodeToString(macBytes)
 	return md, nil
 }
 
@@ -50,6 +67,76 @@ func NewMacaroonCredential(m *macaroon.Macaroon) MacaroonCredential {
 	return ms
 }
 
+// FromMetadata extracts the hex-encoded macaroon stored under the given key of
+// the request metadata and decodes it. ErrMissingMacaroon is returned if
+// there's no macaroon under the key, and an error wrapping ErrInvalidMacaroon
+// if it can't be decoded.
+func FromMetadata(md map[string][]string,
+	key string) (*macaroon.Macaroon, error) {
+
+	values := md[key]
+	switch {
+	case len(values) == 0:
+		return nil, ErrMissingMacaroon
+	case len(values) != 1:
+		return nil, fmt.Errorf("expected 1 macaroon, got %d",
+			len(values))
+	}
+
+	macBytes, err := hex.DecodeString(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMacaroon, err)
+	}
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMacaroon, err)
+	}
+
+	return mac, nil
+}
+
+// ClientIPFromForwarded determines the IP address of the client from the value
+// of an X-Forwarded-For header, for use with IPLockChecker behind a proxy.
+// Every entry of the header was appended by the proxy that received the
+// request from the entry before it, but the client controls the entries it
+// sent itself, so any of them may be spoofed. The chain is therefore walked
+// from the right, skipping the proxies within trustedProxies, and the first
+// address that isn't a trusted proxy is returned: it's the left-most address
+// of the chain that was recorded by a trusted proxy rather than by the client.
+// If every address belongs to a trusted proxy, the left-most one is returned.
+//
+// The header is only meaningful if the request reached us through a trusted
+// proxy, so the caller must check that the address of the peer connection is
+// itself a trusted proxy, and use that address instead otherwise.
+func ClientIPFromForwarded(header string,
+	trustedProxies []*net.IPNet) (string, error) {
+
+	var ip net.IP
+	entries := strings.Split(header, ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		ip = net.ParseIP(entry)
+		if ip == nil {
+			return "", fmt.Errorf("invalid address %q in "+
+				"X-Forwarded-For", entry)
+		}
+		if !ipInNets(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip.String(), nil
+}
+
+// ipInNets returns whether the IP address is within any of the networks.
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ValidateMacaroon validates the capabilities of a given request given a
 // bakery service, context, and uri. Within the passed context.Context, we
 // expect a macaroon to be encoded as request metadata using the key
@@ -64,9 +151,9 @@ func ValidateMacaroon(ctx context.Context, method string,
 	if !ok {
 		return fmt.Errorf("unable to get metadata from context")
 	}
-	if len(md["macaroon"]) != 1 {
-		return fmt.Errorf("expected 1 macaroon, got %d",
-			len(md["macaroon"]))
+	mac, err := FromMetadata(md, MetadataKey)
+	if err != nil {
+		return err
 	}
 
 	// Get peer info and extract IP address from it for macaroon check
@@ -79,26 +166,14 @@ func ValidateMacaroon(ctx context.Context, method string,
 		return fmt.Errorf("unable to parse peer address")
 	}
 
-	// With the macaroon obtained, we'll now decode the hex-string
-	// encoding, then unmarshal it from binary into its concrete struct
-	// representation.
-	macBytes, err := hex.DecodeString(md["macaroon"][0])
-	if err != nil {
-		return err
-	}
-	mac := &macaroon.Macaroon{}
-	err = mac.UnmarshalBinary(macBytes)
-	if err != nil {
-		return err
-	}
-
 	// Check the method being called against the permitted operation and
 	// the expiration time and return the result.
 	//
 	// TODO(aakselrod): Add more checks as required.
-	return svc.Check(macaroon.Slice{mac}, checkers.New(
+	return svc.Check(macaroon.Slice{mac}, caveatChecker(
 		AllowChecker(method),
 		TimeoutChecker(),
 		IPLockChecker(peerAddr),
+		IPRangeChecker(peerAddr),
 	))
 }
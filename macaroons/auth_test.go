@@ -0,0 +1,181 @@
+package macaroons
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"gopkg.in/macaroon-bakery.v1/bakery"
+)
+
+// testRootKeyStore is a bakery.RootKeyStorage holding only the test root key.
+type testRootKeyStore struct{}
+
+// Get returns the test root key whatever the id.
+func (testRootKeyStore) Get(string) ([]byte, error) {
+	return testRootKey, nil
+}
+
+// RootKey returns the test root key along with the test id.
+func (testRootKeyStore) RootKey() ([]byte, string, error) {
+	return testRootKey, testID, nil
+}
+
+// TestFromMetadata tests that a macaroon is decoded from request metadata and
+// that every failure is reported with the matching error.
+func TestFromMetadata(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing macaroon: %v", err)
+	}
+
+	_, err = FromMetadata(map[string][]string{}, MetadataKey)
+	if err != ErrMissingMacaroon {
+		t.Fatalf("expected ErrMissingMacaroon, got %v", err)
+	}
+
+	md := map[string][]string{MetadataKey: {"not hex"}}
+	_, err = FromMetadata(md, MetadataKey)
+	if !errors.Is(err, ErrInvalidMacaroon) {
+		t.Fatalf("expected ErrInvalidMacaroon, got %v", err)
+	}
+
+	md = map[string][]string{MetadataKey: {"abcd"}}
+	_, err = FromMetadata(md, MetadataKey)
+	if !errors.Is(err, ErrInvalidMacaroon) {
+		t.Fatalf("expected ErrInvalidMacaroon, got %v", err)
+	}
+
+	encoded := hex.EncodeToString(macBytes)
+	md = map[string][]string{MetadataKey: {encoded, encoded}}
+	if _, err := FromMetadata(md, MetadataKey); err == nil {
+		t.Fatalf("multiple macaroons accepted")
+	}
+
+	md = map[string][]string{"custom": {encoded}}
+	decoded, err := FromMetadata(md, "custom")
+	if err != nil {
+		t.Fatalf("Error decoding macaroon: %v", err)
+	}
+	if decoded.Id() != mac.Id() {
+		t.Fatalf("expected id %q, got %q", mac.Id(), decoded.Id())
+	}
+}
+
+// TestClientIPFromForwarded tests that the client IP is taken from the right
+// of the X-Forwarded-For chain, past the trusted proxies only.
+func TestClientIPFromForwarded(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", cidr, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+
+	tests := []struct {
+		header   string
+		clientIP string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7, 10.0.0.1", "203.0.113.7"},
+		{"203.0.113.7, 10.0.0.1, 10.0.0.2", "203.0.113.7"},
+		{"2001:db8::1,fd00::1", "2001:db8::1"},
+
+		// Entries left of the first untrusted hop may be spoofed by
+		// the client, so they're ignored.
+		{"10.0.0.9, 198.51.100.1, 203.0.113.7, 10.0.0.1",
+			"203.0.113.7"},
+
+		// With only trusted proxies, the left-most one originated
+		// the request.
+		{"10.0.0.3, 10.0.0.2", "10.0.0.3"},
+	}
+	for _, test := range tests {
+		clientIP, err := ClientIPFromForwarded(test.header, trusted)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", test.header, err)
+		}
+		if clientIP != test.clientIP {
+			t.Fatalf("expected client IP %s for %q, got %s",
+				test.clientIP, test.header, clientIP)
+		}
+	}
+
+	for _, header := range []string{"", "203.0.113.7, bogus, 10.0.0.1"} {
+		_, err := ClientIPFromForwarded(header, trusted)
+		if err == nil {
+			t.Fatalf("expected header %q to be rejected", header)
+		}
+	}
+	// An invalid entry behind the client isn't looked at.
+	if _, err := ClientIPFromForwarded("bogus, 203.0.113.7",
+		trusted); err != nil {
+
+		t.Fatalf("Error parsing header: %v", err)
+	}
+}
+
+// TestValidateMacaroon tests that macaroons locked to an exact IP address or
+// to an IP range are validated against the address of the peer.
+func TestValidateMacaroon(t *testing.T) {
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location:     testLocation,
+		RootKeyStore: testRootKeyStore{},
+	})
+	if err != nil {
+		t.Fatalf("Error creating bakery service: %v", err)
+	}
+
+	tests := []struct {
+		lock   Constraint
+		peerIP string
+		valid  bool
+	}{
+		{IPLockConstraint("10.0.0.1"), "10.0.0.1", true},
+		{IPLockConstraint("10.0.0.1"), "10.0.0.2", false},
+		{IPRangeConstraint("10.1.0.0/16"), "10.1.2.3", true},
+		{IPRangeConstraint("10.1.0.0/16"), "10.2.0.1", false},
+		{IPLockConstraint("10.1.*.*"), "10.1.2.3", true},
+	}
+	for i, test := range tests {
+		mac, err := AddConstraints(
+			createDummyMacaroon(t), AllowConstraint("GetInfo"),
+			test.lock,
+		)
+		if err != nil {
+			t.Fatalf("Error adding constraints: %v", err)
+		}
+		md, err := NewMacaroonCredential(mac).GetRequestMetadata(
+			context.Background(),
+		)
+		if err != nil {
+			t.Fatalf("Error encoding macaroon: %v", err)
+		}
+
+		ctx := metadata.NewContext(
+			context.Background(), metadata.New(md),
+		)
+		ctx = peer.NewContext(ctx, &peer.Peer{
+			Addr: &net.TCPAddr{
+				IP:   net.ParseIP(test.peerIP),
+				Port: 10009,
+			},
+		})
+		err = ValidateMacaroon(ctx, "GetInfo", svc)
+		if test.valid && err != nil {
+			t.Fatalf("test %d: peer %s rejected: %v", i,
+				test.peerIP, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("test %d: peer %s accepted", i, test.peerIP)
+		}
+	}
+}
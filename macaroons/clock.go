@@ -0,0 +1,50 @@
+package macaroons
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time used by time-related constraints
+// and checkers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// systemClock is the default Clock, reading the real system time.
+type systemClock struct{}
+
+// Now implements the Clock interface.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var (
+	clockMtx sync.RWMutex
+	clock    Clock = systemClock{}
+)
+
+// SetClock replaces the clock used by the package, returning the previous
+// one so that it can be restored. A nil clock restores the system clock. This
+// is mainly meant for pinning the time in tests.
+func SetClock(c Clock) Clock {
+	if c == nil {
+		c = systemClock{}
+	}
+
+	clockMtx.Lock()
+	defer clockMtx.Unlock()
+
+	prev := clock
+	clock = c
+	return prev
+}
+
+// now returns the current time according to the package clock.
+func now() time.Time {
+	clockMtx.RLock()
+	defer clockMtx.RUnlock()
+
+	return clock.Now()
+}
@@ -0,0 +1,67 @@
+package macaroons
+
+import (
+	"testing"
+	"time"
+)
+
+// fixedClock is a Clock which always returns the same time.
+type fixedClock time.Time
+
+// Now implements the Clock interface.
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// TestSetClock tests that timeouts are baked and checked against the package
+// clock, and that the system clock can be restored.
+func TestSetClock(t *testing.T) {
+	start := time.Date(2017, 10, 9, 12, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(fixedClock(start)))
+
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	infos := ListCaveats(newMac)
+	if len(infos) != 1 || infos[0].Expiry == nil {
+		t.Fatalf("expected a single expiry, got %v", infos)
+	}
+	if !infos[0].Expiry.Equal(start.Add(time.Minute)) {
+		t.Fatalf("expected expiry %v, got %v", start.Add(time.Minute),
+			infos[0].Expiry)
+	}
+	if infos[0].Remaining != time.Minute {
+		t.Fatalf("expected a minute remaining, got %v",
+			infos[0].Remaining)
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		valid   bool
+	}{
+		{0, true},
+		{59 * time.Second, true},
+		{time.Minute, false},
+		{61 * time.Second, false},
+	}
+	for _, test := range tests {
+		SetClock(fixedClock(start.Add(test.elapsed)))
+		err := checkMacaroon(newMac, TimeoutChecker())
+		if test.valid && err != nil {
+			t.Fatalf("macaroon rejected after %v: %v",
+				test.elapsed, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("macaroon accepted after %v", test.elapsed)
+		}
+	}
+
+	// The real clock is far past the pinned one.
+	SetClock(nil)
+	if err := checkMacaroon(newMac, TimeoutChecker()); err == nil {
+		t.Fatalf("expired macaroon accepted with the system clock")
+	}
+}
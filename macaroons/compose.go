@@ -0,0 +1,160 @@
+package macaroons
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+const (
+	// CondOr is the caveat condition which is satisfied if any of its
+	// nested conditions is satisfied.
+	CondOr = "or"
+
+	// CondAnd is the caveat condition which is satisfied if all of its
+	// nested conditions are satisfied.
+	CondAnd = "and"
+)
+
+// Caveats are always ANDed together when a macaroon is verified, so the only
+// way to express an alternative is to encode several conditions into a single
+// caveat. A composite caveat has the form
+//
+//	or <condition> <condition>...
+//
+// where each nested condition is query-escaped so that it doesn't contain any
+// spaces. Nested conditions are regular caveat conditions, which means they
+// can themselves be composite.
+
+// composeConstraint returns a constraint which adds a single composite caveat
+// with the given condition. Each of the passed constraints must add exactly
+// one caveat, which becomes one of the nested conditions.
+func composeConstraint(cond string,
+	cs []Constraint) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(cond, &err)
+
+		if len(cs) == 0 {
+			return fmt.Errorf("%s constraint needs at least one "+
+				"nested constraint", cond)
+		}
+
+		nested := make([]string, 0, len(cs))
+		for i, constraint := range cs {
+			conditions, err := constraintConditions(constraint)
+			if err != nil {
+				return err
+			}
+			if len(conditions) != 1 {
+				return fmt.Errorf("nested constraint %d of %s "+
+					"adds %d caveats, expected 1", i, cond,
+					len(conditions))
+			}
+			nested = append(nested, url.QueryEscape(conditions[0]))
+		}
+
+		return addCaveat(mac, cond, strings.Join(nested, " "))
+	}
+}
+
+// OrConstraint restricts the macaroon to requests satisfying at least one of
+// the passed constraints. Each of them must add exactly one caveat; several
+// constraints can be grouped into one with AndConstraint.
+func OrConstraint(cs ...Constraint) func(*macaroon.Macaroon) error {
+	return composeConstraint(CondOr, cs)
+}
+
+// AndConstraint restricts the macaroon to requests satisfying all of the
+// passed constraints. On its own this is equivalent to adding the constraints
+// one by one, but it allows grouping them as a single alternative of an
+// OrConstraint.
+func AndConstraint(cs ...Constraint) func(*macaroon.Macaroon) error {
+	return composeConstraint(CondAnd, cs)
+}
+
+// splitComposite unescapes the nested conditions of a composite caveat.
+func splitComposite(cav string) ([]string, error) {
+	fields := strings.Fields(cav)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("composite caveat has no conditions")
+	}
+
+	nested := make([]string, len(fields))
+	for i, field := range fields {
+		condition, err := url.QueryUnescape(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nested condition %q",
+				field)
+		}
+		nested[i] = condition
+	}
+	return nested, nil
+}
+
+// nestedError returns the error of a composite caveat whose nested conditions
+// failed with the given errors. Only their messages are kept: a nested
+// condition that isn't recognized mustn't make the composite caveat look
+// unrecognized as a whole, which would let VerifyLenient skip it.
+func nestedError(msg string, errs []string) error {
+	return fmt.Errorf("%s: %s", msg, strings.Join(errs, "; "))
+}
+
+// OrChecker checks or caveats by evaluating their nested conditions with the
+// passed checkers, succeeding as soon as one of them is satisfied. The
+// checkers must be able to handle every kind of nested condition, including
+// further composite ones.
+func OrChecker(cs ...checkers.Checker) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondOr,
+		Check_: func(_, cav string) error {
+			nested, err := splitComposite(cav)
+			if err != nil {
+				return err
+			}
+
+			check := caveatChecker(cs...)
+			var errs []string
+			for _, condition := range nested {
+				err := check(condition)
+				if err == nil {
+					return nil
+				}
+				errs = append(errs, err.Error())
+			}
+			return nestedError("no alternative satisfied", errs)
+		},
+	}
+}
+
+// AndChecker checks and caveats by evaluating their nested conditions with
+// the passed checkers, failing if any of them isn't satisfied. Every nested
+// condition is evaluated, so that the error reports all of those that failed.
+func AndChecker(cs ...checkers.Checker) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondAnd,
+		Check_: func(_, cav string) error {
+			nested, err := splitComposite(cav)
+			if err != nil {
+				return err
+			}
+
+			check := caveatChecker(cs...)
+			var errs []string
+			for _, condition := range nested {
+				err := check(condition)
+				if err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			if len(errs) == 0 {
+				return nil
+			}
+			return nestedError("not every condition satisfied",
+				errs)
+		},
+	}
+}
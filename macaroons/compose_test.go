@@ -0,0 +1,146 @@
+package macaroons
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// TestOrConstraint tests that an or caveat is satisfied by any single one of
+// its alternatives.
+func TestOrConstraint(t *testing.T) {
+	certHash := sha256.Sum256([]byte("client cert"))
+	fingerprint := hex.EncodeToString(certHash[:])
+	otherHash := sha256.Sum256([]byte("other cert"))
+	otherFingerprint := hex.EncodeToString(otherHash[:])
+
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, OrConstraint(
+		IPLockConstraint("10.0.0.1"), ClientCertConstraint(fingerprint),
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		ip          string
+		fingerprint string
+		valid       bool
+	}{
+		{"10.0.0.1", fingerprint, true},
+		{"10.0.0.1", otherFingerprint, true},
+		{"10.0.0.2", fingerprint, true},
+		{"10.0.0.2", otherFingerprint, false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, OrChecker(
+			IPLockChecker(test.ip),
+			ClientCertChecker(test.fingerprint),
+		))
+		if test.valid && err != nil {
+			t.Fatalf("%v rejected: %v", test, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%v accepted", test)
+		}
+	}
+
+	// Without the or checker, the caveat isn't recognized at all.
+	err = checkMacaroon(newMac, IPLockChecker("10.0.0.1"))
+	if err == nil {
+		t.Fatalf("or caveat accepted without an or checker")
+	}
+
+	// Alternatives must map to exactly one caveat.
+	_, err = AddConstraints(mac, OrConstraint())
+	if err == nil {
+		t.Fatalf("empty or constraint accepted")
+	}
+	_, err = AddConstraints(mac, OrConstraint(IPLockConstraint("")))
+	if err == nil {
+		t.Fatalf("alternative without a caveat accepted")
+	}
+}
+
+// TestAndConstraint tests that an and caveat nested within an or caveat
+// requires all of its conditions to hold.
+func TestAndConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, OrConstraint(
+		AndConstraint(
+			IPLockConstraint("10.0.0.1"),
+			AllowConstraint("GetInfo"),
+		),
+		AllowConstraint("ListChannels"),
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		ip     string
+		method string
+		valid  bool
+	}{
+		{"10.0.0.1", "GetInfo", true},
+		{"10.0.0.2", "GetInfo", false},
+		{"10.0.0.2", "ListChannels", true},
+		{"10.0.0.1", "SendPayment", false},
+	}
+	for _, test := range tests {
+		ipChecker := IPLockChecker(test.ip)
+		allowChecker := AllowChecker(test.method)
+		andChecker := AndChecker(ipChecker, allowChecker)
+		err := checkMacaroon(
+			newMac, OrChecker(andChecker, ipChecker, allowChecker),
+		)
+		if test.valid && err != nil {
+			t.Fatalf("%v rejected: %v", test, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%v accepted", test)
+		}
+	}
+}
+
+// TestCompositeUnknownCondition tests that a composite caveat with an unknown
+// nested condition next to a failing known one fails as a failed caveat, not
+// as an unrecognized one.
+func TestCompositeUnknownCondition(t *testing.T) {
+	unknown := url.QueryEscape("future-thing x")
+	denied := url.QueryEscape("allow SendPayment")
+	tests := []struct {
+		caveat  string
+		checker checkers.Checker
+	}{
+		{CondAnd + " " + unknown + " " + denied,
+			AndChecker(AllowChecker("GetInfo"))},
+		{CondAnd + " " + denied + " " + unknown,
+			AndChecker(AllowChecker("GetInfo"))},
+		{CondOr + " " + unknown + " " + denied,
+			OrChecker(AllowChecker("GetInfo"))},
+	}
+	for _, test := range tests {
+		mac := createDummyMacaroon(t)
+		if err := mac.AddFirstPartyCaveat(test.caveat); err != nil {
+			t.Fatalf("Error adding caveat: %v", err)
+		}
+		err := checkMacaroon(mac, test.checker)
+		if err == nil {
+			t.Fatalf("%q accepted", test.caveat)
+		}
+		if errgo.Cause(err) == checkers.ErrCaveatNotRecognized {
+			t.Fatalf("%q reported as unrecognized: %v",
+				test.caveat, err)
+		}
+		if !strings.Contains(err.Error(), "SendPayment") {
+			t.Fatalf("failure of %q not reported: %v",
+				test.caveat, err)
+		}
+	}
+}
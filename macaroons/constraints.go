@@ -1,30 +1,504 @@
 package macaroons
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
 	macaroon "gopkg.in/macaroon.v1"
 )
 
+const (
+	// CondClientCert is the caveat condition which binds a macaroon to the
+	// SHA256 fingerprint of a TLS client certificate.
+	CondClientCert = "client-cert"
+
+	// CondMaxChannelCapacity is the caveat condition which caps the
+	// capacity, in satoshis, of channels opened with the macaroon.
+	CondMaxChannelCapacity = "max-chan-capacity"
+
+	// CondSchedule is the caveat condition which restricts the use of a
+	// macaroon to a weekly schedule.
+	CondSchedule = "schedule"
+
+	// CondNonce is the caveat condition which makes a macaroon usable
+	// only as long as its nonce hasn't been seen by the server.
+	CondNonce = "nonce"
+
+	// CondMaxDepth is the caveat condition which caps the number of times
+	// a macaroon may be delegated.
+	CondMaxDepth = "max-depth"
+
+	// CondDepth is the caveat condition recording how many times a
+	// macaroon has been delegated.
+	CondDepth = "depth"
+
+	// CondAccount is the caveat condition which restricts a macaroon to
+	// a single wallet account.
+	CondAccount = "account"
+
+	// CondAttestation is the caveat condition which carries a payload
+	// signed by an external attestation key.
+	CondAttestation = "attestation"
+
+	// CondMinConfs is the caveat condition which sets the minimum number
+	// of confirmations a funding operation must require.
+	CondMinConfs = "min-confs"
+
+	// CondAllowRegex is the caveat condition which restricts the allowed
+	// operations to those matching one of a set of regular expressions.
+	CondAllowRegex = "allow-regex"
+
+	// CondUserAgent is the caveat condition which restricts a macaroon to
+	// clients presenting one of a set of user agents.
+	CondUserAgent = "user-agent"
+
+	// CondFiatLimit is the caveat condition which caps the fiat
+	// equivalent, in cents, of the funds spent with a macaroon.
+	CondFiatLimit = "fiat-limit"
+
+	// CondStreamMode is the caveat condition which restricts a macaroon to
+	// either unary or streaming gRPC calls.
+	CondStreamMode = "stream-mode"
+
+	// CondLiquidityLimit is the caveat condition which caps the total
+	// liquidity, in satoshis, moved with a macaroon.
+	CondLiquidityLimit = "liquidity-limit"
+
+	// CondAllowedAddress is the caveat condition which restricts on-chain
+	// sends to a set of destination addresses.
+	CondAllowedAddress = "allowed-addr"
+
+	// CondVelocity is the caveat condition which caps the amount, in
+	// satoshis, spent with a macaroon within a rolling time window.
+	CondVelocity = "velocity"
+
+	// CondRequireAllIPs is the caveat condition which requires a request
+	// to come from every one of a set of IP addresses.
+	CondRequireAllIPs = "client-ip-all"
+
+	// CondIssuedAt is the caveat condition recording when a macaroon was
+	// issued, which a ttl caveat is relative to.
+	CondIssuedAt = "issued-at"
+
+	// CondTTL is the caveat condition which expires a macaroon after a
+	// number of seconds past its issued-at time.
+	CondTTL = "ttl"
+
+	// CondSession is the caveat condition which binds a macaroon to a
+	// session, outside of which it isn't valid.
+	CondSession = "session"
+
+	// CondLabel is the caveat condition which attaches a human readable
+	// label to a macaroon without restricting it.
+	CondLabel = "label"
+
+	// CondMaxFeeRate is the caveat condition which caps the fee rate, in
+	// satoshis per virtual byte, of on-chain transactions.
+	CondMaxFeeRate = "max-fee-rate"
+
+	// CondDailyUse is the caveat condition which restricts a macaroon to
+	// being used at most once per calendar day.
+	CondDailyUse = "daily-use"
+
+	// CondClientIPRange is the caveat condition which locks a macaroon to
+	// clients within a range of IP addresses.
+	CondClientIPRange = "client-ip-range"
+
+	// CondScope is the caveat condition which restricts a macaroon to the
+	// methods of a set of named scopes defined by the server.
+	CondScope = "scope"
+
+	// CondAuthority is the caveat condition which locks a macaroon to
+	// requests addressed to a gRPC authority.
+	CondAuthority = "authority"
+
+	// CondTLSSession is the caveat condition which binds a macaroon to a
+	// single TLS session.
+	CondTLSSession = "tls-session"
+
+	// CondMaxCLTV is the caveat condition which caps the CLTV delta, in
+	// blocks, for which a payment may lock up funds in flight.
+	CondMaxCLTV = "max-cltv"
+
+	// CondFundingAccount is the caveat condition which restricts the
+	// wallet account that transactions may be funded from.
+	CondFundingAccount = "funding-account"
+
+	// CondOnionOnly is the caveat condition which restricts a macaroon to
+	// requests that reached the node through its Tor onion address.
+	CondOnionOnly = "onion-only"
+
+	// CondDangerAck is the caveat condition which acknowledges that a
+	// macaroon is meant to be used for dangerous operations.
+	CondDangerAck = "danger-ack"
+
+	// CondNoKeysend is the caveat condition which forbids a macaroon from
+	// making keysend payments.
+	CondNoKeysend = "no-keysend"
+
+	// CondMaxStreams is the caveat condition which caps the number of
+	// streams a macaroon may have open at once.
+	CondMaxStreams = "max-streams"
+
+	// CondDischargeLocations is the caveat condition which restricts the
+	// third parties that may discharge the caveats of a macaroon.
+	CondDischargeLocations = "discharge-locations"
+
+	// CondCategory is the caveat condition which restricts a macaroon to
+	// the methods of a set of categories, such as "wallet".
+	CondCategory = "category"
+
+	// CondMaxPage is the caveat condition which caps the number of items
+	// a list call made with a macaroon may return in a single page.
+	CondMaxPage = "max-page"
+
+	// CondMaxPeers is the caveat condition which caps the number of peers
+	// a single call made with a macaroon may involve.
+	CondMaxPeers = "max-peers"
+)
+
+// Mode is the kind of gRPC call a macaroon may be used for.
+type Mode int
+
+const (
+	// Any allows both unary and streaming calls.
+	Any Mode = iota
+
+	// Unary only allows unary calls.
+	Unary
+
+	// Stream only allows streaming calls.
+	Stream
+)
+
+// String returns the name of the mode as used in stream-mode caveats.
+func (m Mode) String() string {
+	switch m {
+	case Any:
+		return "any"
+	case Unary:
+		return "unary"
+	case Stream:
+		return "stream"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// InvoiceOnlyMethods is the set of methods allowed by InvoiceOnlyConstraint:
+// creating invoices, and looking them up to poll their status. The methods
+// are named after the permissions lnd checks for each RPC.
+var InvoiceOnlyMethods = []string{
+	"addinvoice",
+	"readinvoices",
+}
+
+// CloseChannelMethods is the set of methods denied by NoCloseConstraint.
+var CloseChannelMethods = []string{
+	"closechannel",
+}
+
 // Constraint type adds a layer of indirection over macaroon caveats and
 // checkers.
+//
+// Constraints and checkers keep no mutable state of their own, or guard it
+// when they do, so the same values may be used from many goroutines at once.
+// The only exceptions are checkers documented as tracking state across the
+// caveats of a macaroon, which need a new instance for every verification.
 type Constraint func(*macaroon.Macaroon) error
 
 // AddConstraints returns new derived macaroon by applying every passed
-// constraint and tightening its restrictions.
+// constraint and tightening its restrictions. If a constraint fails, the
+// returned error wraps its error along with its position in cs and, for the
+// constraints of this package, the condition of the caveat it would have
+// added, e.g. "constraint 2 (time-before) failed: ...".
 func AddConstraints(mac *macaroon.Macaroon, cs ...Constraint) (*macaroon.Macaroon, error) {
 	newMac := mac.Clone()
-	for _, constraint := range cs {
-		if err := constraint(newMac); err != nil {
+	for i, constraint := range cs {
+		err := constraint(newMac)
+		if err == nil {
+			continue
+		}
+
+		var condErr *conditionError
+		if errors.As(err, &condErr) {
+			return nil, fmt.Errorf("constraint %d (%s) failed: %w",
+				i, condErr.cond, err)
+		}
+		return nil, fmt.Errorf("constraint %d failed: %w", i, err)
+	}
+	return newMac, nil
+}
+
+// conditionError is the error of a failed constraint, tagged with the
+// condition of the caveat the constraint adds.
+type conditionError struct {
+	cond string
+	err  error
+}
+
+// Error implements the error interface.
+func (e *conditionError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the constraint.
+func (e *conditionError) Unwrap() error {
+	return e.err
+}
+
+// tagCondition tags the error pointed to, if any, with the condition of the
+// caveat added by the failed constraint. It's meant to be deferred by
+// constraints, so that AddConstraints can report which kind of constraint
+// failed. Empty conditions are left out.
+func tagCondition(cond string, err *error) {
+	if *err != nil && cond != "" {
+		*err = &conditionError{cond: cond, err: *err}
+	}
+}
+
+// Relocate re-bakes the macaroon from its root key with a new location, e.g.
+// after the node moved to another host, keeping its id and every caveat. The
+// macaroon must verify against the root key, and third-party caveats can't be
+// carried over since their caveat keys are unknown. The new macaroon doesn't
+// replace the old one: copies bearing the old location remain just as valid.
+func Relocate(mac *macaroon.Macaroon, rootKey []byte,
+	newLocation string) (*macaroon.Macaroon, error) {
+
+	return rebake(mac, rootKey, newLocation, nil)
+}
+
+// MinimalFor bakes a new macaroon from the root key which authorizes the
+// request described by ctx and as little else as possible. The derivation
+// rules are:
+//
+//   - the macaroon gets a random id and the "lnd" location,
+//   - an allow caveat permits only ctx.Method, which must be set,
+//   - if ctx.ClientIP is set, an IP lock restricts the macaroon to it.
+//
+// The checkers of ctx don't translate into any caveat, and the macaroon
+// doesn't expire, so callers should add a TimeoutConstraint for anything
+// longer-lived than a test.
+func MinimalFor(rootKey []byte, ctx RequestContext) (*macaroon.Macaroon,
+	error) {
+
+	if ctx.Method == "" {
+		return nil, fmt.Errorf("request has no method")
+	}
+	cs := []Constraint{AllowConstraint(ctx.Method)}
+	if ctx.ClientIP != "" {
+		if net.ParseIP(ctx.ClientIP) == nil {
+			return nil, fmt.Errorf("invalid client IP %q",
+				ctx.ClientIP)
+		}
+		cs = append(cs, IPLockConstraint(ctx.ClientIP))
+	}
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	mac, err := macaroon.New(rootKey, hex.EncodeToString(id[:]), "lnd")
+	if err != nil {
+		return nil, err
+	}
+	return AddConstraints(mac, cs...)
+}
+
+// informationalDependents maps informational caveat conditions to the
+// enforcing condition that relies on them, and without which they can be
+// dropped by Minify.
+var informationalDependents = map[string]string{
+	CondIssuedAt: CondTTL,
+	CondDepth:    CondMaxDepth,
+}
+
+// Minify re-bakes the macaroon from its root key without its informational
+// caveats, such as labels, to reduce its size on the wire. The annotations
+// are lost for good, so a macaroon should only be minified for transport to
+// a verifier that doesn't need them. Informational caveats that an enforcing
+// caveat relies on are kept: issued-at times if there's a ttl caveat, and
+// delegation depths if there's a max-depth caveat. Like with Relocate, the
+// macaroon must verify against the root key and can't carry third-party
+// caveats.
+func Minify(mac *macaroon.Macaroon,
+	rootKey []byte) (*macaroon.Macaroon, error) {
+
+	present := make(map[string]bool)
+	for _, caveat := range mac.Caveats() {
+		if cond, _, err := parseCaveat(caveat.Id); err == nil {
+			present[cond] = true
+		}
+	}
+
+	keep := func(condition string) bool {
+		cond, _, err := parseCaveat(condition)
+		if err != nil {
+			return true
+		}
+		if _, ok := informationalConditions[cond]; !ok {
+			return true
+		}
+		dependent, ok := informationalDependents[cond]
+		return ok && present[dependent]
+	}
+	return rebake(mac, rootKey, mac.Location(), keep)
+}
+
+// rebake bakes a new macaroon from the root key with the id of the passed one
+// and the given location, carrying over the first-party caveats for which
+// keep returns true, or all of them if keep is nil. The macaroon must verify
+// against the root key and must not have any third-party caveats.
+func rebake(mac *macaroon.Macaroon, rootKey []byte, location string,
+	keep func(condition string) bool) (*macaroon.Macaroon, error) {
+
+	for _, caveat := range mac.Caveats() {
+		if caveat.Location != "" {
+			return nil, fmt.Errorf("third-party caveats can't " +
+				"be re-baked")
+		}
+	}
+	if err := VerifySignature(mac, rootKey); err != nil {
+		return nil, fmt.Errorf("macaroon doesn't match root key: %v",
+			err)
+	}
+
+	newMac, err := macaroon.New(rootKey, mac.Id(), location)
+	if err != nil {
+		return nil, err
+	}
+	for _, caveat := range mac.Caveats() {
+		if keep != nil && !keep(caveat.Id) {
+			continue
+		}
+		if err := newMac.AddFirstPartyCaveat(caveat.Id); err != nil {
 			return nil, err
 		}
 	}
 	return newMac, nil
 }
 
+// addCaveat adds a first-party caveat built from the given condition and
+// argument to the macaroon.
+func addCaveat(mac *macaroon.Macaroon, cond, arg string) error {
+	if arg == "" {
+		return mac.AddFirstPartyCaveat(cond)
+	}
+	return mac.AddFirstPartyCaveat(cond + " " + arg)
+}
+
+// normalizeCaveat trims whitespace around a first-party caveat condition and
+// between its identifier and argument, which some other macaroon libraries
+// and serialization paths leave behind. A condition that can't be parsed is
+// only trimmed.
+func normalizeCaveat(caveat string) string {
+	caveat = strings.TrimSpace(caveat)
+	cond, arg, err := checkers.ParseCaveat(caveat)
+	if err != nil {
+		return caveat
+	}
+	if arg = strings.TrimSpace(arg); arg == "" {
+		return cond
+	}
+	return cond + " " + arg
+}
+
+// parseCaveat splits a first-party caveat condition into its identifier and
+// argument like checkers.ParseCaveat does, tolerating surrounding whitespace.
+func parseCaveat(caveat string) (string, string, error) {
+	return checkers.ParseCaveat(normalizeCaveat(caveat))
+}
+
+// caveatCheckerFunc checks a single first-party caveat condition.
+type caveatCheckerFunc func(caveat string) error
+
+// CheckFirstPartyCaveat implements the bakery.FirstPartyChecker interface.
+func (f caveatCheckerFunc) CheckFirstPartyCaveat(caveat string) error {
+	return f(caveat)
+}
+
+// caveatChecker returns a function checking first-party caveat conditions
+// with the passed checkers, tolerating whitespace around the conditions.
+func caveatChecker(cs ...checkers.Checker) caveatCheckerFunc {
+	checker := checkers.New(cs...)
+	return func(caveat string) error {
+		return checker.CheckFirstPartyCaveat(normalizeCaveat(caveat))
+	}
+}
+
+// constraintConditions returns the caveat conditions the passed constraints
+// add to a macaroon, without adding them to any real macaroon.
+func constraintConditions(cs ...Constraint) ([]string, error) {
+	scratch, err := macaroon.New(nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, constraint := range cs {
+		if err := constraint(scratch); err != nil {
+			return nil, err
+		}
+	}
+
+	var conditions []string
+	for _, caveat := range scratch.Caveats() {
+		if caveat.Location != "" {
+			return nil, fmt.Errorf("third-party caveats aren't " +
+				"supported")
+		}
+		conditions = append(conditions, caveat.Id)
+	}
+	return conditions, nil
+}
+
+// SkipDuplicates wraps the passed constraints so that the caveats they add are
+// skipped if the macaroon already carries them, e.g. when re-applying a stored
+// policy to a macaroon that went through it before.
+//
+// Only caveats with the exact same condition are skipped, since a first-party
+// caveat identical to an existing one can't restrict the macaroon any
+// further. Caveats merely sharing an identifier, like two time-before caveats
+// with different expiries, are all added.
+func SkipDuplicates(cs ...Constraint) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) error {
+		conditions, err := constraintConditions(cs...)
+		if err != nil {
+			return err
+		}
+
+		existing := make(map[string]struct{})
+		for _, caveat := range mac.Caveats() {
+			if caveat.Location == "" {
+				existing[caveat.Id] = struct{}{}
+			}
+		}
+		for _, cond := range conditions {
+			if _, ok := existing[cond]; ok {
+				continue
+			}
+			if err := mac.AddFirstPartyCaveat(cond); err != nil {
+				return err
+			}
+			existing[cond] = struct{}{}
+		}
+		return nil
+	}
+}
+
 // Each *Constraint function is a functional option, which takes a pointer
 // to the macaroon and adds another restriction to it. For each *Constraint,
 // the corresponding *Checker is provided.
@@ -32,7 +506,9 @@ func AddConstraints(mac *macaroon.Macaroon, cs ...Constraint) (*macaroon.Macaroo
 // AllowConstraint restricts allowed operations set to the ones
 // passed to it.
 func AllowConstraint(ops ...string) func(*macaroon.Macaroon) error {
-	return func(mac *macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(checkers.CondAllow, &err)
+
 		caveat := checkers.AllowCaveat(ops...)
 		return mac.AddFirstPartyCaveat(caveat.Condition)
 	}
@@ -43,37 +519,127 @@ func AllowChecker(method string) checkers.Checker {
 	return checkers.OperationChecker(method)
 }
 
+// InvoiceOnlyConstraint restricts the macaroon to creating invoices and
+// checking their status, i.e. to the methods in InvoiceOnlyMethods. A common
+// use is handing a macaroon to a merchant frontend that must not move funds.
+func InvoiceOnlyConstraint() func(*macaroon.Macaroon) error {
+	return AllowConstraint(InvoiceOnlyMethods...)
+}
+
+// NoCloseConstraint denies the methods in CloseChannelMethods, so that the
+// macaroon may be used to open channels but not to close them. It's
+// checked by AllowChecker like any other deny caveat.
+func NoCloseConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(checkers.CondDeny, &err)
+
+		caveat := checkers.DenyCaveat(CloseChannelMethods...)
+		return mac.AddFirstPartyCaveat(caveat.Condition)
+	}
+}
+
 // TimeoutConstraint restricts the lifetime of the macaroon
 // to the amount of seconds given.
 func TimeoutConstraint(seconds int64) func(*macaroon.Macaroon) error {
-	return func(mac *macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(checkers.CondTimeBefore, &err)
+
 		macaroonTimeout := time.Duration(seconds)
-		requestTimeout := time.Now().Add(time.Second * macaroonTimeout)
+		requestTimeout := now().Add(time.Second * macaroonTimeout)
 		caveat := checkers.TimeBeforeCaveat(requestTimeout)
 		return mac.AddFirstPartyCaveat(caveat.Condition)
 	}
 }
 
-// TimeoutChecker wraps default checkers.TimeBefore checker.
+// TimeoutChecker checks time-before caveats like the default
+// checkers.TimeBefore checker does, but against the package clock.
 func TimeoutChecker() checkers.Checker {
-	return checkers.TimeBefore
+	return checkers.CheckerFunc{
+		Condition_: checkers.CondTimeBefore,
+		Check_: func(_, cav string) error {
+			expiry, err := time.Parse(time.RFC3339Nano, cav)
+			if err != nil {
+				return fmt.Errorf("invalid time-before caveat "+
+					"%q", cav)
+			}
+			if !now().Before(expiry) {
+				return fmt.Errorf("macaroon has expired")
+			}
+			return nil
+		},
+	}
 }
 
 // IPLockConstraint locks macaroon to a specific IP address.
 // If address is an empty string, this constraint does nothing to
-// accommodate default value's desired behavior.
+// accommodate default value's desired behavior. Instead of a single address,
+// a range can be given either in CIDR notation, e.g. "192.168.1.0/24", or as
+// an IPv4 address with trailing wildcard octets, e.g. "192.168.1.*", which is
+// translated to the equivalent CIDR range. Ranges are locked with
+// IPRangeConstraint, so that client-ip-addr caveats always hold an exact
+// address as the bakery expects.
 func IPLockConstraint(ipAddr string) func(*macaroon.Macaroon) error {
-	return func(mac *macaroon.Macaroon) error {
-		if ipAddr != "" {
-			macaroonIPAddr := net.ParseIP(ipAddr)
-			if macaroonIPAddr == nil {
-				return fmt.Errorf("incorrect macaroon IP-lock address")
+	return func(mac *macaroon.Macaroon) (err error) {
+		if ipAddr == "" {
+			return nil
+		}
+
+		// Ranges are reported as client-ip-range failures, since
+		// that's the caveat they would have added.
+		if strings.Contains(ipAddr, "*") {
+			cidr, err := wildcardToCIDR(ipAddr)
+			if err != nil {
+				tagCondition(CondClientIPRange, &err)
+				return err
 			}
-			caveat := checkers.ClientIPAddrCaveat(macaroonIPAddr)
-			return mac.AddFirstPartyCaveat(caveat.Condition)
+			return IPRangeConstraint(cidr)(mac)
 		}
-		return nil
+		if strings.Contains(ipAddr, "/") {
+			return IPRangeConstraint(ipAddr)(mac)
+		}
+
+		defer tagCondition(checkers.CondClientIPAddr, &err)
+
+		macaroonIPAddr := net.ParseIP(ipAddr)
+		if macaroonIPAddr == nil {
+			return fmt.Errorf("incorrect macaroon IP-lock address")
+		}
+		caveat := checkers.ClientIPAddrCaveat(macaroonIPAddr)
+		return mac.AddFirstPartyCaveat(caveat.Condition)
+	}
+}
+
+// wildcardToCIDR translates an IPv4 address whose trailing octets are
+// wildcards, e.g. "192.168.*.*", to the equivalent range in CIDR notation.
+// Wildcards are only allowed as whole trailing octets, and at least one octet
+// must be given.
+func wildcardToCIDR(wildcard string) (string, error) {
+	octets := strings.Split(wildcard, ".")
+	if len(octets) != 4 {
+		return "", fmt.Errorf("invalid wildcard IP %q", wildcard)
+	}
+
+	prefix := 0
+	for i, octet := range octets {
+		if octet == "*" {
+			continue
+		}
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil || prefix != i*8 {
+			return "", fmt.Errorf("invalid wildcard IP %q",
+				wildcard)
+		}
+		octets[i] = strconv.FormatUint(n, 10)
+		prefix += 8
+	}
+	if prefix == 0 {
+		return "", fmt.Errorf("wildcard IP %q matches every "+
+			"address", wildcard)
 	}
+	for i := prefix / 8; i < len(octets); i++ {
+		octets[i] = "0"
+	}
+	return strings.Join(octets, ".") + "/" + strconv.Itoa(prefix), nil
 }
 
 // IPLockChecker accepts client IP from the validation context and compares it
@@ -90,3 +656,1514 @@ func IPLockChecker(clientIP string) checkers.Checker {
 		},
 	}
 }
+
+// IPRangeConstraint locks the macaroon to clients whose IP address is within
+// the given range in CIDR notation, e.g. "10.0.0.0/8".
+func IPRangeConstraint(cidr string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondClientIPRange, &err)
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid IP range %q", cidr)
+		}
+		return addCaveat(mac, CondClientIPRange, ipNet.String())
+	}
+}
+
+// IPRangeChecker accepts client IP from the validation context and checks
+// that it's within the IP range locked in the macaroon.
+func IPRangeChecker(clientIP string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondClientIPRange,
+		Check_: func(_, cav string) error {
+			_, ipNet, err := net.ParseCIDR(cav)
+			if err != nil {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondClientIPRange, cav)
+			}
+			ip := net.ParseIP(clientIP)
+			if ip == nil || !ipNet.Contains(ip) {
+				return fmt.Errorf("macaroon locked to " +
+					"IP range not containing client")
+			}
+			return nil
+		},
+	}
+}
+
+// RequireAllIPsConstraint locks the macaroon to clients reporting every one
+// of the given IP addresses. Unlike IPLockConstraint, which matches a single
+// address, this is meant for multi-homed servers whose requests are seen from
+// several source addresses at once, e.g. behind several proxies, where the
+// macaroon should only validate for that exact combination.
+func RequireAllIPsConstraint(ipAddrs ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondRequireAllIPs, &err)
+
+		if len(ipAddrs) == 0 {
+			return fmt.Errorf("at least one IP address is required")
+		}
+
+		ips := make([]string, len(ipAddrs))
+		for i, ipAddr := range ipAddrs {
+			ip := net.ParseIP(ipAddr)
+			if ip == nil {
+				return fmt.Errorf("invalid IP address %q",
+					ipAddr)
+			}
+			ips[i] = ip.String()
+		}
+		return addCaveat(mac, CondRequireAllIPs, strings.Join(ips, " "))
+	}
+}
+
+// RequireAllIPsChecker accepts every IP address reported for the client and
+// checks that all the addresses required by the macaroon are among them.
+func RequireAllIPsChecker(clientIPs []string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondRequireAllIPs,
+		Check_: func(_, cav string) error {
+			for _, field := range strings.Fields(cav) {
+				required := net.ParseIP(field)
+				if required == nil {
+					return fmt.Errorf("invalid IP address "+
+						"%q", field)
+				}
+
+				found := false
+				for _, clientIP := range clientIPs {
+					ip := net.ParseIP(clientIP)
+					if required.Equal(ip) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return fmt.Errorf("request not from "+
+						"required IP address %s", field)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// ClientCertConstraint binds the macaroon to the TLS client certificate with
+// the given hex-encoded SHA256 fingerprint. A macaroon carrying this
+// constraint is useless without the matching certificate.
+func ClientCertConstraint(fingerprint string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondClientCert, &err)
+
+		certHash, err := hex.DecodeString(fingerprint)
+		if err != nil || len(certHash) != sha256.Size {
+			return fmt.Errorf("fingerprint must be %d "+
+				"hex-encoded bytes", sha256.Size)
+		}
+		return addCaveat(
+			mac, CondClientCert, hex.EncodeToString(certHash),
+		)
+	}
+}
+
+// ClientCertChecker accepts the fingerprint of the certificate presented by
+// the client and compares it in constant time with the one locked in the
+// macaroon.
+func ClientCertChecker(presentedFingerprint string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondClientCert,
+		Check_: func(_, cav string) error {
+			expected, err := hex.DecodeString(cav)
+			if err != nil {
+				return fmt.Errorf("invalid fingerprint " +
+					"in macaroon")
+			}
+			presented, err := hex.DecodeString(presentedFingerprint)
+			if err != nil {
+				return fmt.Errorf("invalid fingerprint " +
+					"presented")
+			}
+
+			match := subtle.ConstantTimeCompare(expected, presented)
+			if match != 1 {
+				return fmt.Errorf("macaroon locked to " +
+					"different certificate")
+			}
+			return nil
+		},
+	}
+}
+
+// TLSSessionConstraint binds the macaroon to a single TLS session, identified
+// by an opaque value such as the tls-unique channel binding of the
+// connection. This is stronger than binding it to a client certificate, as
+// the macaroon can't be replayed over any other connection.
+func TLSSessionConstraint(sessionID []byte) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondTLSSession, &err)
+
+		if len(sessionID) == 0 {
+			return fmt.Errorf("TLS session id must not be empty")
+		}
+		return addCaveat(
+			mac, CondTLSSession,
+			base64.StdEncoding.EncodeToString(sessionID),
+		)
+	}
+}
+
+// TLSSessionChecker accepts the identifier of the TLS session of the current
+// connection and compares it in constant time with the one locked in the
+// macaroon.
+func TLSSessionChecker(currentID []byte) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondTLSSession,
+		Check_: func(_, cav string) error {
+			expected, err := base64.StdEncoding.DecodeString(cav)
+			if err != nil || len(expected) == 0 {
+				return fmt.Errorf("invalid TLS session in " +
+					"macaroon")
+			}
+
+			match := subtle.ConstantTimeCompare(expected, currentID)
+			if match != 1 {
+				return fmt.Errorf("macaroon locked to " +
+					"different TLS session")
+			}
+			return nil
+		},
+	}
+}
+
+// maxValueConstraint returns a constraint which caps the value identified by
+// the given condition. The cap must be positive.
+func maxValueConstraint(cond string, max int64) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(cond, &err)
+
+		if max <= 0 {
+			return fmt.Errorf("%s must be positive, got %d", cond,
+				max)
+		}
+		return addCaveat(mac, cond, strconv.FormatInt(max, 10))
+	}
+}
+
+// maxValueChecker returns a checker for the given condition which fails if
+// the requested value is above the cap locked in the macaroon.
+func maxValueChecker(cond string, requested int64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: cond,
+		Check_: func(_, cav string) error {
+			max, err := strconv.ParseInt(cav, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s caveat %q", cond,
+					cav)
+			}
+			if requested > max {
+				return fmt.Errorf("requested %d is above %s "+
+					"of %d", requested, cond, max)
+			}
+			return nil
+		},
+	}
+}
+
+// minValueChecker returns a checker for the given condition which fails if
+// the requested value is below the minimum locked in the macaroon.
+func minValueChecker(cond string, requested int64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: cond,
+		Check_: func(_, cav string) error {
+			min, err := strconv.ParseInt(cav, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s caveat %q", cond,
+					cav)
+			}
+			if requested < min {
+				return fmt.Errorf("requested %d is below %s "+
+					"of %d", requested, cond, min)
+			}
+			return nil
+		},
+	}
+}
+
+// MaxChannelCapacityConstraint restricts the macaroon to opening channels
+// with at most the given capacity in satoshis.
+func MaxChannelCapacityConstraint(sat int64) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxChannelCapacity, sat)
+}
+
+// MaxChannelCapacityChecker accepts the capacity of the channel being opened
+// and rejects it if it's above the cap locked in the macaroon.
+func MaxChannelCapacityChecker(requestedSat int64) checkers.Checker {
+	return maxValueChecker(CondMaxChannelCapacity, requestedSat)
+}
+
+// MaxFeeRateConstraint caps the fee rate, in satoshis per virtual byte, that
+// on-chain transactions made with the macaroon may pay.
+func MaxFeeRateConstraint(satPerVByte int64) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxFeeRate, satPerVByte)
+}
+
+// MaxFeeRateChecker accepts the fee rate requested for an on-chain
+// transaction and rejects it if it's above the cap locked in the macaroon.
+func MaxFeeRateChecker(requestedRate int64) checkers.Checker {
+	return maxValueChecker(CondMaxFeeRate, requestedRate)
+}
+
+// MaxCLTVConstraint caps the total time lock, in blocks, of the payments made
+// with the macaroon, which bounds how long their funds can be locked in flight
+// if the route stalls.
+func MaxCLTVConstraint(blocks int) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxCLTV, int64(blocks))
+}
+
+// MaxCLTVChecker accepts the total time lock requested for a payment and
+// rejects it if it's above the cap locked in the macaroon.
+func MaxCLTVChecker(requestedBlocks int) checkers.Checker {
+	return maxValueChecker(CondMaxCLTV, int64(requestedBlocks))
+}
+
+// MaxStreamsConstraint caps the number of streaming calls, such as
+// subscriptions, that may be open with the macaroon at the same time.
+func MaxStreamsConstraint(n int) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxStreams, int64(n))
+}
+
+// MaxStreamsChecker accepts the number of streams currently open with the
+// macaroon, not counting the one being opened, and rejects opening another if
+// that many are already open as the macaroon allows. Keeping track of the
+// open streams is up to the caller.
+func MaxStreamsChecker(currentOpen int) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondMaxStreams,
+		Check_: func(_, cav string) error {
+			max, err := strconv.ParseInt(cav, 10, 64)
+			if err != nil || max <= 0 {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondMaxStreams, cav)
+			}
+			if int64(currentOpen) >= max {
+				return fmt.Errorf("%d streams already open, "+
+					"at most %d allowed", currentOpen, max)
+			}
+			return nil
+		},
+	}
+}
+
+// MaxPageSizeConstraint caps the page size that list calls, such as listing
+// invoices or payments, may request with the macaroon, so that it can't be
+// used to scan the whole database in one call.
+func MaxPageSizeConstraint(n int) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxPage, int64(n))
+}
+
+// MaxPageSizeChecker accepts the page size requested by a list call and
+// rejects it if it's above the cap locked in the macaroon.
+func MaxPageSizeChecker(requested int) checkers.Checker {
+	return maxValueChecker(CondMaxPage, int64(requested))
+}
+
+// MaxPeersConstraint caps the number of peers that a single batch call, such
+// as opening channels to several peers at once, may involve when made with the
+// macaroon.
+func MaxPeersConstraint(n int) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondMaxPeers, int64(n))
+}
+
+// MaxPeersChecker accepts the number of peers involved in a call and rejects
+// it if it's above the cap locked in the macaroon.
+func MaxPeersChecker(count int) checkers.Checker {
+	return maxValueChecker(CondMaxPeers, int64(count))
+}
+
+// LiquidityLimitConstraint caps the total liquidity, in satoshis, that may be
+// shifted in or out of channels with the macaroon. Unlike per-payment caps,
+// the limit applies to the running total across every use of the macaroon.
+func LiquidityLimitConstraint(sat int64) func(*macaroon.Macaroon) error {
+	return maxValueConstraint(CondLiquidityLimit, sat)
+}
+
+// LiquidityLimitChecker accepts the total liquidity moved with the macaroon so
+// far, including the requested operation, and rejects it if it's above the
+// cap locked in the macaroon. Keeping track of the total is up to the caller.
+func LiquidityLimitChecker(movedSat int64) checkers.Checker {
+	return maxValueChecker(CondLiquidityLimit, movedSat)
+}
+
+// ScheduleConstraint restricts the use of the macaroon to the given days of
+// the week, between the start and end times of day. Both times are offsets
+// from midnight UTC. If end is before start, the window wraps past midnight
+// and its early-morning part belongs to the day the window opened, e.g.
+// Friday 22:00 to 02:00 includes Saturday 01:00 but not Friday 01:00.
+func ScheduleConstraint(days []time.Weekday,
+	start, end time.Duration) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondSchedule, &err)
+
+		if len(days) == 0 {
+			return fmt.Errorf("schedule needs at least one day")
+		}
+		if start < 0 || start >= 24*time.Hour ||
+			end < 0 || end >= 24*time.Hour {
+
+			return fmt.Errorf("schedule times must be within a day")
+		}
+		if start == end {
+			return fmt.Errorf("schedule window must not be empty")
+		}
+
+		seen := make(map[time.Weekday]struct{})
+		var dayNums []int
+		for _, day := range days {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("invalid weekday %d", day)
+			}
+			if _, ok := seen[day]; ok {
+				continue
+			}
+			seen[day] = struct{}{}
+			dayNums = append(dayNums, int(day))
+		}
+		sort.Ints(dayNums)
+
+		dayStrs := make([]string, len(dayNums))
+		for i, day := range dayNums {
+			dayStrs[i] = strconv.Itoa(day)
+		}
+		arg := fmt.Sprintf("%s %d %d", strings.Join(dayStrs, ","),
+			int64(start/time.Second), int64(end/time.Second))
+		return addCaveat(mac, CondSchedule, arg)
+	}
+}
+
+// ScheduleChecker accepts the current time and checks that it falls within
+// the weekly schedule locked in the macaroon.
+func ScheduleChecker(now time.Time) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondSchedule,
+		Check_: func(_, cav string) error {
+			fields := strings.Fields(cav)
+			if len(fields) != 3 {
+				return fmt.Errorf("invalid schedule caveat")
+			}
+			start, err1 := strconv.ParseInt(fields[1], 10, 64)
+			end, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid schedule caveat")
+			}
+
+			utcNow := now.UTC()
+			midnight := time.Date(
+				utcNow.Year(), utcNow.Month(), utcNow.Day(), 0,
+				0, 0, 0, time.UTC,
+			)
+			offset := int64(utcNow.Sub(midnight) / time.Second)
+
+			// For a window wrapping past midnight, the part after
+			// midnight belongs to the previous day.
+			day := utcNow.Weekday()
+			inWindow := offset >= start && offset < end
+			if start > end {
+				inWindow = offset >= start || offset < end
+				if offset < end {
+					day = (day + 6) % 7
+				}
+			}
+			if !inWindow {
+				return fmt.Errorf("macaroon not valid at " +
+					"this time of day")
+			}
+
+			for _, dayStr := range strings.Split(fields[0], ",") {
+				if dayStr == strconv.Itoa(int(day)) {
+					return nil
+				}
+			}
+			return fmt.Errorf("macaroon not valid on %v", day)
+		},
+	}
+}
+
+// stringValueConstraint returns a constraint which adds a caveat with the
+// given condition and value. The value must not be empty.
+func stringValueConstraint(cond,
+	value string) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(cond, &err)
+
+		if value == "" {
+			return fmt.Errorf("%s must not be empty", cond)
+		}
+		return addCaveat(mac, cond, value)
+	}
+}
+
+// stringValueChecker returns a checker for the given condition which fails
+// unless the presented value is exactly the one locked in the macaroon.
+func stringValueChecker(cond, presented string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: cond,
+		Check_: func(_, cav string) error {
+			if cav == "" || cav != presented {
+				return fmt.Errorf("macaroon locked to "+
+					"different %s", cond)
+			}
+			return nil
+		},
+	}
+}
+
+// NonceConstraint adds a nonce to the macaroon, which allows the server to
+// reject a request replaying a nonce it has already observed.
+func NonceConstraint(nonce string) func(*macaroon.Macaroon) error {
+	return stringValueConstraint(CondNonce, nonce)
+}
+
+// NonceChecker rejects a macaroon whose nonce has already been observed. The
+// server keeps track of observed nonces itself and reports them through the
+// passed predicate, which is responsible for recording the nonce if the
+// request is to be single-use.
+func NonceChecker(seen func(nonce string) bool) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondNonce,
+		Check_: func(_, cav string) error {
+			if cav == "" {
+				return fmt.Errorf("empty nonce in macaroon")
+			}
+			if seen(cav) {
+				return fmt.Errorf("macaroon nonce already used")
+			}
+			return nil
+		},
+	}
+}
+
+// DelegationDepth returns how many times the macaroon has been delegated with
+// Delegate, which is the highest depth recorded in its caveats. Since caveats
+// can only be added, a holder can't lower the depth by adding another depth
+// caveat.
+func DelegationDepth(mac *macaroon.Macaroon) (int, error) {
+	depth := 0
+	for _, caveat := range mac.Caveats() {
+		cond, arg, err := parseCaveat(caveat.Id)
+		if err != nil || cond != CondDepth {
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid depth caveat %q",
+				caveat.Id)
+		}
+		if n > depth {
+			depth = n
+		}
+	}
+	return depth, nil
+}
+
+// Delegate derives a new macaroon like AddConstraints does, additionally
+// recording that the macaroon went through one more delegation. Only
+// delegations made through this function are counted: a holder attenuating
+// the macaroon directly doesn't increase its depth.
+func Delegate(mac *macaroon.Macaroon,
+	cs ...Constraint) (*macaroon.Macaroon, error) {
+
+	depth, err := DelegationDepth(mac)
+	if err != nil {
+		return nil, err
+	}
+
+	newMac, err := AddConstraints(mac, cs...)
+	if err != nil {
+		return nil, err
+	}
+	err = addCaveat(newMac, CondDepth, strconv.Itoa(depth+1))
+	if err != nil {
+		return nil, err
+	}
+	return newMac, nil
+}
+
+// DelegationDepthConstraint caps the number of times the macaroon may be
+// further delegated with Delegate. The caveat records the resulting total
+// depth, that is the depth of the macaroon when the constraint is added plus
+// max, so applying it midway through a chain doesn't count the delegations
+// that already happened.
+func DelegationDepthConstraint(max int) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondMaxDepth, &err)
+
+		if max < 0 {
+			return fmt.Errorf("maximum depth must not be negative")
+		}
+		depth, err := DelegationDepth(mac)
+		if err != nil {
+			return err
+		}
+		return addCaveat(mac, CondMaxDepth, strconv.Itoa(depth+max))
+	}
+}
+
+// DelegationDepthChecker accepts the delegation depth of the macaroon, as
+// returned by DelegationDepth, and rejects it if it exceeds any of its
+// maximum depth caveats. It also accepts the depth caveats themselves.
+func DelegationDepthChecker(currentDepth int) checkers.Checker {
+	return checkers.New(
+		checkers.CheckerFunc{
+			Condition_: CondDepth,
+			Check_: func(_, _ string) error {
+				return nil
+			},
+		},
+		checkers.CheckerFunc{
+			Condition_: CondMaxDepth,
+			Check_: func(_, cav string) error {
+				max, err := strconv.Atoi(cav)
+				if err != nil {
+					return fmt.Errorf("invalid max-depth "+
+						"caveat %q", cav)
+				}
+				if currentDepth > max {
+					return fmt.Errorf("macaroon delegated "+
+						"%d times, at most %d allowed",
+						currentDepth, max)
+				}
+				return nil
+			},
+		},
+	)
+}
+
+// AccountConstraint restricts the macaroon to operations on the wallet
+// account with the given id.
+func AccountConstraint(accountID string) func(*macaroon.Macaroon) error {
+	return stringValueConstraint(CondAccount, accountID)
+}
+
+// AccountChecker accepts the account a request operates on and rejects it if
+// it's not the one locked in the macaroon.
+func AccountChecker(requestAccount string) checkers.Checker {
+	return stringValueChecker(CondAccount, requestAccount)
+}
+
+// FundingAccountConstraint restricts the macaroon to funding transactions,
+// e.g. PSBTs, from the wallet account with the given id. Unlike
+// AccountConstraint, it only scopes where funds are drawn from, not which
+// account every operation acts on.
+func FundingAccountConstraint(account string) func(*macaroon.Macaroon) error {
+	return stringValueConstraint(CondFundingAccount, account)
+}
+
+// FundingAccountChecker accepts the account a transaction is requested to be
+// funded from and rejects it if it's not the one locked in the macaroon.
+func FundingAccountChecker(requestedAccount string) checkers.Checker {
+	return stringValueChecker(CondFundingAccount, requestedAccount)
+}
+
+// AttestationConstraint attaches the given payload and its ed25519 signature
+// to the macaroon, binding an external attestation to it. The signature is
+// only verified by AttestationChecker, but it must be well-formed. The payload
+// must not be empty either, as the caveat of an empty one would never parse.
+func AttestationConstraint(payload, sig []byte) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondAttestation, &err)
+
+		if len(payload) == 0 {
+			return fmt.Errorf("attestation payload must not be " +
+				"empty")
+		}
+		if len(sig) != ed25519.SignatureSize {
+			return fmt.Errorf("attestation signature must be %d "+
+				"bytes", ed25519.SignatureSize)
+		}
+		arg := base64.StdEncoding.EncodeToString(payload) + " " +
+			base64.StdEncoding.EncodeToString(sig)
+		return addCaveat(mac, CondAttestation, arg)
+	}
+}
+
+// AttestationChecker verifies the signature of every attestation attached to
+// the macaroon against the given public key.
+func AttestationChecker(pubKey ed25519.PublicKey) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondAttestation,
+		Check_: func(_, cav string) error {
+			fields := strings.Fields(cav)
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid attestation caveat")
+			}
+			enc := base64.StdEncoding
+			payload, err1 := enc.DecodeString(fields[0])
+			sig, err2 := enc.DecodeString(fields[1])
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid attestation caveat")
+			}
+
+			if len(pubKey) != ed25519.PublicKeySize ||
+				!ed25519.Verify(pubKey, payload, sig) {
+
+				return fmt.Errorf("invalid attestation " +
+					"signature")
+			}
+			return nil
+		},
+	}
+}
+
+// MinConfsConstraint requires funding operations made with the macaroon to
+// wait for at least the given number of confirmations.
+func MinConfsConstraint(confs int) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondMinConfs, &err)
+
+		if confs < 0 {
+			return fmt.Errorf("%s must not be negative, got %d",
+				CondMinConfs, confs)
+		}
+		return addCaveat(mac, CondMinConfs, strconv.Itoa(confs))
+	}
+}
+
+// MinConfsChecker accepts the number of confirmations requested by a funding
+// operation and rejects it if it's below the policy locked in the macaroon.
+func MinConfsChecker(requestedConfs int) checkers.Checker {
+	return minValueChecker(CondMinConfs, int64(requestedConfs))
+}
+
+// AllowRegexConstraint restricts the allowed operations to those matching at
+// least one of the given regular expressions. Patterns aren't implicitly
+// anchored, so they should generally start with ^ and end with $. Every
+// pattern is compiled up front so that a malformed one is caught here rather
+// than at verification time. Go's regular expressions run in linear time, so
+// no pattern can make verification blow up.
+func AllowRegexConstraint(patterns ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondAllowRegex, &err)
+
+		if len(patterns) == 0 {
+			return fmt.Errorf("at least one pattern is required")
+		}
+
+		escaped := make([]string, len(patterns))
+		for i, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v",
+					pattern, err)
+			}
+			escaped[i] = url.QueryEscape(pattern)
+		}
+		arg := strings.Join(escaped, " ")
+		return addCaveat(mac, CondAllowRegex, arg)
+	}
+}
+
+// AllowRegexChecker accepts the invoked method and checks it against the
+// patterns of the allow-regex caveats of the macaroon.
+func AllowRegexChecker(method string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondAllowRegex,
+		Check_: func(_, cav string) error {
+			for _, field := range strings.Fields(cav) {
+				pattern, err := url.QueryUnescape(field)
+				if err != nil {
+					return fmt.Errorf("invalid %s caveat",
+						CondAllowRegex)
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid pattern "+
+						"%q: %v", pattern, err)
+				}
+				if re.MatchString(method) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s not allowed", method)
+		},
+	}
+}
+
+// UserAgentConstraint restricts the macaroon to clients presenting one of the
+// given user agents. An agent ending in * matches any user agent starting
+// with the rest of it. This is a weak binding, as clients are free to claim
+// any user agent.
+func UserAgentConstraint(agents ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondUserAgent, &err)
+
+		if len(agents) == 0 {
+			return fmt.Errorf("at least one user agent is required")
+		}
+
+		escaped := make([]string, len(agents))
+		for i, agent := range agents {
+			if agent == "" || agent == "*" {
+				return fmt.Errorf("user agent must not be " +
+					"empty")
+			}
+			escaped[i] = url.QueryEscape(agent)
+		}
+		return addCaveat(mac, CondUserAgent, strings.Join(escaped, " "))
+	}
+}
+
+// UserAgentChecker accepts the user agent presented by the client and checks
+// that it matches one of those locked in the macaroon.
+func UserAgentChecker(presented string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondUserAgent,
+		Check_: func(_, cav string) error {
+			for _, field := range strings.Fields(cav) {
+				agent, err := url.QueryUnescape(field)
+				if err != nil {
+					return fmt.Errorf("invalid " +
+						"user-agent caveat")
+				}
+
+				prefix := strings.TrimSuffix(agent, "*")
+				if agent == presented || (prefix != agent &&
+					strings.HasPrefix(presented, prefix)) {
+
+					return nil
+				}
+			}
+			return fmt.Errorf("user agent %q not allowed",
+				presented)
+		},
+	}
+}
+
+// parseCurrency validates a 3-letter currency code, returning it upper-cased.
+func parseCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(currency)
+	if len(currency) != 3 {
+		return "", fmt.Errorf("invalid currency code %q", currency)
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("invalid currency code %q",
+				currency)
+		}
+	}
+	return currency, nil
+}
+
+// FiatLimitConstraint caps the amount spent with the macaroon to the given
+// number of cents of a fiat currency, e.g. "USD". The limit is snapshotted
+// when the macaroon is baked; converting spent amounts to the currency is left
+// to the caller of the checker.
+func FiatLimitConstraint(currency string,
+	cents int64) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondFiatLimit, &err)
+
+		currency, err := parseCurrency(currency)
+		if err != nil {
+			return err
+		}
+		if cents < 0 {
+			return fmt.Errorf("%s must not be negative, got %d",
+				CondFiatLimit, cents)
+		}
+		arg := currency + " " + strconv.FormatInt(cents, 10)
+		return addCaveat(mac, CondFiatLimit, arg)
+	}
+}
+
+// FiatLimitChecker accepts the amount spent, already converted to cents of
+// the given currency, and rejects it if it's above the limit locked in the
+// macaroon or if the limit is set in another currency.
+func FiatLimitChecker(currency string, spentCents int64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondFiatLimit,
+		Check_: func(_, cav string) error {
+			fields := strings.Fields(cav)
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid fiat-limit caveat")
+			}
+			limit, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid fiat-limit caveat")
+			}
+
+			if !strings.EqualFold(currency, fields[0]) {
+				return fmt.Errorf("spending limit is in %s, "+
+					"not %s", fields[0], currency)
+			}
+			if spentCents > limit {
+				return fmt.Errorf("spent %d is above limit of "+
+					"%d %s cents", spentCents, limit,
+					fields[0])
+			}
+			return nil
+		},
+	}
+}
+
+// StreamModeConstraint restricts the macaroon to unary or streaming calls,
+// e.g. to keep it from being used for long-lived subscriptions. Any doesn't
+// add a caveat.
+func StreamModeConstraint(mode Mode) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondStreamMode, &err)
+
+		switch mode {
+		case Any:
+			return nil
+		case Unary, Stream:
+			return addCaveat(mac, CondStreamMode, mode.String())
+		default:
+			return fmt.Errorf("unknown mode %v", mode)
+		}
+	}
+}
+
+// StreamModeChecker accepts whether the invoked call is a streaming one and
+// checks it against the mode locked in the macaroon.
+func StreamModeChecker(isStream bool) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondStreamMode,
+		Check_: func(_, cav string) error {
+			mode := Unary
+			if isStream {
+				mode = Stream
+			}
+			switch cav {
+			case mode.String():
+				return nil
+			case Unary.String(), Stream.String():
+				return fmt.Errorf("%v calls not allowed", mode)
+			default:
+				return fmt.Errorf("invalid stream-mode caveat "+
+					"%q", cav)
+			}
+		},
+	}
+}
+
+// AllowedAddressConstraint restricts on-chain sends made with the macaroon to
+// the given destination addresses. Addresses are only checked for being
+// non-empty and free of whitespace, not for being valid on any network.
+func AllowedAddressConstraint(addrs ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondAllowedAddress, &err)
+
+		if len(addrs) == 0 {
+			return fmt.Errorf("at least one address is required")
+		}
+		for _, addr := range addrs {
+			if addr == "" || strings.ContainsAny(addr, " \t\n\r") {
+				return fmt.Errorf("invalid address %q", addr)
+			}
+		}
+		arg := strings.Join(addrs, " ")
+		return addCaveat(mac, CondAllowedAddress, arg)
+	}
+}
+
+// AllowedAddressChecker accepts the destination address of an on-chain send
+// and rejects it unless it's one of the addresses locked in the macaroon.
+func AllowedAddressChecker(destAddr string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondAllowedAddress,
+		Check_: func(_, cav string) error {
+			for _, addr := range strings.Fields(cav) {
+				if addr == destAddr {
+					return nil
+				}
+			}
+			return fmt.Errorf("sending to %s not allowed", destAddr)
+		},
+	}
+}
+
+// VelocityConstraint caps the amount spent with the macaroon within any
+// rolling window of the given duration, e.g. 1 BTC per hour. The window is
+// truncated to whole seconds and must be at least one second long.
+func VelocityConstraint(sat int64,
+	window time.Duration) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondVelocity, &err)
+
+		if sat <= 0 {
+			return fmt.Errorf("%s must be positive, got %d",
+				CondVelocity, sat)
+		}
+		seconds := int64(window / time.Second)
+		if seconds <= 0 {
+			return fmt.Errorf("%s window must be at least a "+
+				"second, got %v", CondVelocity, window)
+		}
+		arg := fmt.Sprintf("%d %d", sat, seconds)
+		return addCaveat(mac, CondVelocity, arg)
+	}
+}
+
+// VelocityChecker accepts the amount spent with the macaroon within the
+// window of its velocity caveat, including the requested operation, and
+// rejects it if it's above the cap. Accounting for the spending in the window,
+// which can be found with ListCaveats, is up to the caller.
+func VelocityChecker(spentInWindow int64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondVelocity,
+		Check_: func(_, cav string) error {
+			fields := strings.Fields(cav)
+			if len(fields) != 2 {
+				return fmt.Errorf("invalid velocity caveat")
+			}
+			max, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid velocity caveat")
+			}
+			if spentInWindow > max {
+				return fmt.Errorf("spent %d is above %d per "+
+					"%ss", spentInWindow, max, fields[1])
+			}
+			return nil
+		},
+	}
+}
+
+// RelativeExpiryConstraint expires the macaroon once the given time to live,
+// truncated to whole seconds, has passed since it was issued. Rather than a
+// single time-before caveat, it adds an issued-at caveat with the current time
+// followed by a ttl caveat, so that the ttl of a policy template can be
+// reused as is.
+func RelativeExpiryConstraint(
+	ttl time.Duration) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondTTL, &err)
+
+		seconds := int64(ttl / time.Second)
+		if seconds <= 0 {
+			return fmt.Errorf("ttl must be at least a second, got "+
+				"%v", ttl)
+		}
+
+		issuedAt := now().UTC().Format(time.RFC3339Nano)
+		if err := addCaveat(mac, CondIssuedAt, issuedAt); err != nil {
+			return err
+		}
+		return addCaveat(mac, CondTTL, strconv.FormatInt(seconds, 10))
+	}
+}
+
+// RelativeExpiryChecker checks the ttl caveats of the macaroon against the
+// given time, each relative to the issued-at caveat preceding it, the way
+// RelativeExpiryConstraint adds them. A ttl caveat without an issued-at caveat
+// before it fails, as does an issued-at caveat followed by another one before
+// its ttl caveat. Every pair is checked on its own, so that attenuating the
+// macaroon with a later issued-at time or a longer ttl can't extend its
+// lifetime.
+//
+// Caveats are checked one at a time, so an issued-at caveat at the very end of
+// the macaroon can't be told apart from one about to be followed by its ttl.
+// RelativeExpiryPairsChecker rejects those once the caveats are verified.
+//
+// The checker keeps state across the caveats of a macaroon, so a new one must
+// be used for every verification.
+func RelativeExpiryChecker(now time.Time) checkers.Checker {
+	var (
+		mu       sync.Mutex
+		issuedAt time.Time
+		pending  bool
+	)
+
+	return checkers.New(
+		checkers.CheckerFunc{
+			Condition_: CondIssuedAt,
+			Check_: func(_, cav string) error {
+				t, err := time.Parse(time.RFC3339Nano, cav)
+				if err != nil {
+					return fmt.Errorf("invalid issued-at "+
+						"caveat %q", cav)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if pending {
+					return fmt.Errorf("issued-at caveat " +
+						"without ttl")
+				}
+				issuedAt, pending = t, true
+				return nil
+			},
+		},
+		checkers.CheckerFunc{
+			Condition_: CondTTL,
+			Check_: func(_, cav string) error {
+				ttl, err := parseTTL(cav)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if !pending {
+					return fmt.Errorf("ttl caveat " +
+						"without issued-at time")
+				}
+				pending = false
+
+				expiry := issuedAt.Add(ttl)
+				if !now.Before(expiry) {
+					return fmt.Errorf("macaroon expired "+
+						"at %v", expiry)
+				}
+				return nil
+			},
+		},
+	)
+}
+
+// RelativeExpiryPairsChecker returns a MacaroonChecker which fails if an
+// issued-at or ttl caveat of the macaroon isn't paired with the other, as
+// RelativeExpiryConstraint adds them. It complements RelativeExpiryChecker,
+// which can't see the end of the macaroon.
+func RelativeExpiryPairsChecker() MacaroonChecker {
+	return func(mac *macaroon.Macaroon) error {
+		_, err := relativeExpiry(ListCaveats(mac))
+		return err
+	}
+}
+
+// parseTTL parses the argument of a ttl caveat.
+func parseTTL(cav string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(cav, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid ttl caveat %q", cav)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// relativeExpiry pairs every ttl caveat among the passed ones with the
+// issued-at caveat preceding it, and returns the earliest of the resulting
+// expiries, or nil if there's no complete pair. It fails if a caveat is left
+// unpaired or can't be parsed, in which case the earliest expiry among the
+// pairs before the offending caveat is still returned.
+func relativeExpiry(infos []CaveatInfo) (*time.Time, error) {
+	var (
+		expiry   *time.Time
+		issuedAt *time.Time
+	)
+	for _, info := range infos {
+		if info.Location != "" || info.Err != nil {
+			continue
+		}
+
+		switch info.Identifier {
+		case CondIssuedAt:
+			if issuedAt != nil {
+				return expiry, fmt.Errorf("issued-at " +
+					"caveat without ttl")
+			}
+			t, err := time.Parse(time.RFC3339Nano, info.Argument)
+			if err != nil {
+				return expiry, fmt.Errorf("invalid "+
+					"issued-at caveat %q", info.Argument)
+			}
+			issuedAt = &t
+
+		case CondTTL:
+			if issuedAt == nil {
+				return expiry, fmt.Errorf("ttl caveat " +
+					"without issued-at time")
+			}
+			ttl, err := parseTTL(info.Argument)
+			if err != nil {
+				return expiry, err
+			}
+			t := issuedAt.Add(ttl)
+			if expiry == nil || t.Before(*expiry) {
+				expiry = &t
+			}
+			issuedAt = nil
+		}
+	}
+	if issuedAt != nil {
+		return expiry, fmt.Errorf("issued-at caveat without ttl")
+	}
+	return expiry, nil
+}
+
+// SessionConstraint binds the macaroon to the session with the given id, e.g.
+// a short-lived CLI session, so that it stops being valid once the session
+// ends.
+func SessionConstraint(sessionID string) func(*macaroon.Macaroon) error {
+	return stringValueConstraint(CondSession, sessionID)
+}
+
+// SessionChecker rejects a macaroon bound to a session that is no longer
+// active. The server keeps track of sessions itself and reports whether one
+// is still active through the passed predicate.
+func SessionChecker(active func(id string) bool) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondSession,
+		Check_: func(_, cav string) error {
+			if cav == "" {
+				return fmt.Errorf("empty session in macaroon")
+			}
+			if !active(cav) {
+				return fmt.Errorf("session %s is no longer "+
+					"active", cav)
+			}
+			return nil
+		},
+	}
+}
+
+// LabelConstraint attaches a human readable label to the macaroon, e.g. the
+// name of the application it was baked for. A label doesn't restrict the
+// macaroon in any way.
+func LabelConstraint(label string) func(*macaroon.Macaroon) error {
+	return stringValueConstraint(CondLabel, label)
+}
+
+// LabelChecker accepts every label caveat, which is needed for macaroons
+// carrying labels to verify.
+func LabelChecker() checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondLabel,
+		Check_: func(_, _ string) error {
+			return nil
+		},
+	}
+}
+
+// DailyUseConstraint restricts the macaroon to being used at most once per
+// calendar day in UTC, e.g. for faucet tokens.
+func DailyUseConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondDailyUse, &err)
+
+		return addCaveat(mac, CondDailyUse, "")
+	}
+}
+
+// DailyUseChecker accepts the time the macaroon was last used, or the zero
+// time if it never was, along with the current time, and rejects the macaroon
+// if both fall on the same UTC date. Keeping track of the last use is up to
+// the caller.
+func DailyUseChecker(lastUsed time.Time, now time.Time) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondDailyUse,
+		Check_: func(_, cav string) error {
+			if cav != "" {
+				return fmt.Errorf("invalid daily-use caveat")
+			}
+			if lastUsed.IsZero() {
+				return nil
+			}
+
+			y1, m1, d1 := lastUsed.UTC().Date()
+			y2, m2, d2 := now.UTC().Date()
+			if y1 == y2 && m1 == m2 && d1 == d2 {
+				return fmt.Errorf("macaroon already used on "+
+					"%04d-%02d-%02d", y2, m2, d2)
+			}
+			return nil
+		},
+	}
+}
+
+// ScopeConstraint restricts the macaroon to the methods belonging to any of
+// the given named scopes, e.g. "readonly" or "invoice". The methods of each
+// scope are defined by the server when the macaroon is verified, so they can
+// change without re-issuing macaroons. Like allow caveats, several scope
+// caveats restrict the macaroon to the methods allowed by all of them.
+func ScopeConstraint(scopes ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondScope, &err)
+
+		if len(scopes) == 0 {
+			return fmt.Errorf("at least one scope is required")
+		}
+		for _, scope := range scopes {
+			if scope == "" ||
+				strings.ContainsAny(scope, " \t\n\r") {
+
+				return fmt.Errorf("invalid scope %q", scope)
+			}
+		}
+		return addCaveat(mac, CondScope, strings.Join(scopes, " "))
+	}
+}
+
+// ScopeChecker accepts the invoked method and checks that it belongs to one of
+// the scopes locked in the macaroon, using resolve to expand each scope into
+// its methods. An unknown scope should resolve to no methods.
+func ScopeChecker(resolve func(scope string) []string,
+	method string) checkers.Checker {
+
+	return checkers.CheckerFunc{
+		Condition_: CondScope,
+		Check_: func(_, cav string) error {
+			for _, scope := range strings.Fields(cav) {
+				for _, m := range resolve(scope) {
+					if m == method {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("%s not in scopes %s", method, cav)
+		},
+	}
+}
+
+// CategoryConstraint restricts the macaroon to the methods tagged with any of
+// the given categories, e.g. "wallet", "channels" or "peers". Unlike with
+// scopes, each method belongs to a single category, which the server resolves
+// when the macaroon is verified. Several category caveats restrict the
+// macaroon to the categories allowed by all of them.
+func CategoryConstraint(cats ...string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondCategory, &err)
+
+		if len(cats) == 0 {
+			return fmt.Errorf("at least one category is required")
+		}
+		for _, cat := range cats {
+			if cat == "" || strings.ContainsAny(cat, " \t\n\r") {
+				return fmt.Errorf("invalid category %q", cat)
+			}
+		}
+		return addCaveat(mac, CondCategory, strings.Join(cats, " "))
+	}
+}
+
+// CategoryChecker accepts the invoked method and checks that its category, as
+// resolved by the passed function, is one of the categories locked in the
+// macaroon. Methods without a category should resolve to an empty string,
+// which is never allowed.
+func CategoryChecker(method string,
+	category func(method string) string) checkers.Checker {
+
+	return checkers.CheckerFunc{
+		Condition_: CondCategory,
+		Check_: func(_, cav string) error {
+			cat := category(method)
+			if cat == "" {
+				return fmt.Errorf("%s has no category", method)
+			}
+			for _, allowed := range strings.Fields(cav) {
+				if allowed == cat {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s of category %s not in "+
+				"categories %s", method, cat, cav)
+		},
+	}
+}
+
+// splitAuthority splits a gRPC authority of the form host[:port] into its host
+// and optional port. IPv6 hosts must be enclosed in brackets.
+func splitAuthority(authority string) (string, string, error) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		// Without a port, the authority is only the host.
+		host, port = authority, ""
+		bracketed := strings.HasPrefix(host, "[") &&
+			strings.HasSuffix(host, "]")
+		if bracketed {
+			host = host[1 : len(host)-1]
+		}
+	} else if n, err := strconv.ParseUint(port, 10, 16); err != nil ||
+		n == 0 {
+
+		return "", "", fmt.Errorf("invalid port in authority %q",
+			authority)
+	}
+	if host == "" || strings.ContainsAny(host, " \t\n\r[]/") {
+		return "", "", fmt.Errorf("invalid authority %q", authority)
+	}
+	return host, port, nil
+}
+
+// AuthorityConstraint locks the macaroon to requests whose :authority, the
+// logical service they're addressed to, matches the given host[:port]. Hosts
+// are compared case-insensitively, and an authority without a port matches
+// requests to any port of the host. This keeps a macaroon minted for one
+// service backend from being replayed to another behind the same mesh.
+func AuthorityConstraint(authority string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondAuthority, &err)
+
+		host, port, err := splitAuthority(authority)
+		if err != nil {
+			return err
+		}
+		host = strings.ToLower(host)
+		if port != "" {
+			return addCaveat(mac, CondAuthority,
+				net.JoinHostPort(host, port))
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return addCaveat(mac, CondAuthority, host)
+	}
+}
+
+// AuthorityChecker checks that the :authority the request was presented with
+// matches the one locked in the macaroon.
+func AuthorityChecker(presented string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondAuthority,
+		Check_: func(_, cav string) error {
+			host, port, err := splitAuthority(cav)
+			if err != nil {
+				return err
+			}
+			gotHost, gotPort, err := splitAuthority(presented)
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(host, gotHost) ||
+				(port != "" && port != gotPort) {
+
+				return fmt.Errorf("macaroon locked to "+
+					"authority %s, not %s", cav, presented)
+			}
+			return nil
+		},
+	}
+}
+
+// isOnionHost returns whether the host is a Tor onion service address, i.e. a
+// base32-encoded v2 or v3 service name followed by ".onion".
+func isOnionHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name := strings.TrimSuffix(host, ".onion")
+	if name == host || (len(name) != 16 && len(name) != 56) {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '2' && c <= '7') {
+			return false
+		}
+	}
+	return true
+}
+
+// OnionOnlyConstraint restricts the macaroon to requests addressed to an onion
+// address of the node, for operators only reaching their node over Tor.
+func OnionOnlyConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondOnionOnly, &err)
+
+		return addCaveat(mac, CondOnionOnly, "")
+	}
+}
+
+// OnionChecker accepts the address, in host[:port] form, that the request was
+// addressed to, such as its :authority, and rejects it unless it's an onion
+// address.
+func OnionChecker(clientAddr string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondOnionOnly,
+		Check_: func(_, cav string) error {
+			if cav != "" {
+				return fmt.Errorf("invalid %s caveat",
+					CondOnionOnly)
+			}
+			host, _, err := splitAuthority(clientAddr)
+			if err != nil || !isOnionHost(host) {
+				return fmt.Errorf("request to %q not made "+
+					"over an onion address", clientAddr)
+			}
+			return nil
+		},
+	}
+}
+
+// DangerAckConstraint marks the macaroon as explicitly meant for dangerous
+// operations, such as closing channels or sweeping funds, which is required by
+// DangerAckChecker.
+//
+// Since caveats can be added by any holder, the acknowledgement only guards
+// against handing out a macaroon for destructive operations by accident. It
+// doesn't keep a holder from acknowledging the danger themselves, so dangerous
+// operations should still be excluded by allow or deny caveats where needed.
+func DangerAckConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondDangerAck, &err)
+
+		return addCaveat(mac, CondDangerAck, "")
+	}
+}
+
+// NoKeysendConstraint forbids the macaroon from making keysend payments, i.e.
+// spontaneous payments without an invoice, while still allowing invoices to
+// be paid.
+func NoKeysendConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondNoKeysend, &err)
+
+		return addCaveat(mac, CondNoKeysend, "")
+	}
+}
+
+// KeysendChecker accepts whether the requested payment is a keysend payment,
+// and rejects it if so.
+func KeysendChecker(isKeysend bool) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondNoKeysend,
+		Check_: func(_, cav string) error {
+			if cav != "" {
+				return fmt.Errorf("invalid %s caveat",
+					CondNoKeysend)
+			}
+			if isKeysend {
+				return fmt.Errorf("keysend payments not " +
+					"allowed")
+			}
+			return nil
+		},
+	}
+}
+
+// AllowedDischargeLocationsConstraint restricts the macaroon to being
+// discharged only by third parties at the given locations. This is checked by
+// DischargeLocationsChecker, which rejects any third-party caveat, of
+// the macaroon or of its discharges, addressed to another location, as well as
+// discharges claiming another location.
+//
+// The restriction is only advisory: the locations of third-party caveats and
+// discharges aren't covered by any signature, so a holder can have a caveat
+// discharged anywhere and rewrite the locations to allowed ones afterwards.
+// It guards against mistakes, not against a malicious holder.
+func AllowedDischargeLocationsConstraint(
+	locations ...string) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondDischargeLocations, &err)
+
+		if len(locations) == 0 {
+			return fmt.Errorf("at least one discharge location " +
+				"is required")
+		}
+		for _, loc := range locations {
+			if loc == "" || strings.ContainsAny(loc, " \t\n\r") {
+				return fmt.Errorf("invalid discharge "+
+					"location %q", loc)
+			}
+		}
+		return addCaveat(
+			mac, CondDischargeLocations,
+			strings.Join(locations, " "),
+		)
+	}
+}
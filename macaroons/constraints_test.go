@@ -0,0 +1,1940 @@
+package macaroons
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+var (
+	testRootKey  = []byte("dummyRootKey")
+	testID       = "dummyId"
+	testLocation = "lnd"
+)
+
+// createDummyMacaroon creates a new macaroon without any caveats, minted
+// from the test root key.
+func createDummyMacaroon(t *testing.T) *macaroon.Macaroon {
+	mac, err := macaroon.New(testRootKey, testID, testLocation)
+	if err != nil {
+		t.Fatalf("Error creating initial macaroon: %v", err)
+	}
+	return mac
+}
+
+// checkMacaroon verifies the macaroon against the test root key using the
+// passed checkers.
+func checkMacaroon(mac *macaroon.Macaroon, cs ...checkers.Checker) error {
+	checker := checkers.New(cs...)
+	return mac.Verify(testRootKey, checker.CheckFirstPartyCaveat, nil)
+}
+
+// TestIPLockWildcard tests that IP locks given as wildcards or CIDR ranges
+// are baked as IP range locks matching every client within the range, while
+// exact locks keep working.
+func TestIPLockWildcard(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	badLocks := []string{
+		"192.*.1.5", "192.168.*.5", "*.*.*.*", "192.168.1",
+		"192.168.1.**", "192.168.256.*", "192.168.1.0/33",
+	}
+	for _, lock := range badLocks {
+		constraint := IPLockConstraint(lock)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("IP lock %q should be rejected", lock)
+		}
+	}
+
+	tests := []struct {
+		lock     string
+		caveat   string
+		clientIP string
+		valid    bool
+	}{
+		{"192.168.1.*", "client-ip-range 192.168.1.0/24",
+			"192.168.1.77", true},
+		{"192.168.1.*", "client-ip-range 192.168.1.0/24",
+			"192.168.2.77", false},
+		{"10.*.*.*", "client-ip-range 10.0.0.0/8", "10.20.30.40",
+			true},
+		{"10.1.2.3/16", "client-ip-range 10.1.0.0/16",
+			"10.1.9.9", true},
+		{"10.1.2.3/16", "client-ip-range 10.1.0.0/16",
+			"10.2.0.1", false},
+		{"10.0.0.1", "client-ip-addr 10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "client-ip-addr 10.0.0.1", "10.0.0.2", false},
+	}
+	for _, test := range tests {
+		newMac, err := AddConstraints(mac, IPLockConstraint(test.lock))
+		if err != nil {
+			t.Fatalf("Error adding constraint for %s: %v",
+				test.lock, err)
+		}
+		if caveat := newMac.Caveats()[0].Id; caveat != test.caveat {
+			t.Fatalf("expected caveat %q for %s, got %q",
+				test.caveat, test.lock, caveat)
+		}
+		err = checkMacaroon(
+			newMac, IPLockChecker(test.clientIP),
+			IPRangeChecker(test.clientIP),
+		)
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected for %s: %v", test.clientIP,
+				test.lock, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted for %s", test.clientIP, test.lock)
+		}
+	}
+}
+
+// TestIPRangeConstraint tests that only clients within the locked range are
+// accepted.
+func TestIPRangeConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, cidr := range []string{"", "10.0.0.1", "10.0.0.0/33"} {
+		constraint := IPRangeConstraint(cidr)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("IP range %q should be rejected", cidr)
+		}
+	}
+
+	// The range is stored in its canonical form.
+	newMac, err := AddConstraints(mac, IPRangeConstraint("10.1.2.3/16"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	caveat := newMac.Caveats()[0].Id
+	if caveat != "client-ip-range 10.1.0.0/16" {
+		t.Fatalf("unexpected caveat %q", caveat)
+	}
+
+	tests := []struct {
+		clientIP string
+		valid    bool
+	}{
+		{"10.1.0.1", true},
+		{"10.1.255.255", true},
+		{"10.2.0.1", false},
+		{"2001:db8::1", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, IPRangeChecker(test.clientIP))
+		if test.valid && err != nil {
+			t.Fatalf("client IP %q rejected: %v", test.clientIP,
+				err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("client IP %q accepted", test.clientIP)
+		}
+	}
+}
+
+// TestRequireAllIPsConstraint tests that a request is only accepted if every
+// required IP address is among those reported for the client.
+func TestRequireAllIPsConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, ips := range [][]string{nil, {"10.0.0.1", "10.0.0"}} {
+		constraint := RequireAllIPsConstraint(ips...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("IP addresses %v should be rejected", ips)
+		}
+	}
+
+	newMac, err := AddConstraints(
+		mac, RequireAllIPsConstraint("10.0.0.1", "2001:db8::1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		clientIPs []string
+		valid     bool
+	}{
+		{[]string{"10.0.0.1", "2001:db8::1"}, true},
+		{[]string{"2001:db8:0::1", "10.0.0.2", "10.0.0.1"}, true},
+		{[]string{"10.0.0.1"}, false},
+		{[]string{"2001:db8::1", "10.0.0.2"}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		checker := RequireAllIPsChecker(test.clientIPs)
+		err := checkMacaroon(newMac, checker)
+		if test.valid && err != nil {
+			t.Fatalf("client IPs %v rejected: %v", test.clientIPs,
+				err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("client IPs %v accepted", test.clientIPs)
+		}
+	}
+}
+
+// TestInvoiceOnlyConstraint tests that an invoice-only macaroon can create
+// and look up invoices, but not pay.
+func TestInvoiceOnlyConstraint(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), InvoiceOnlyConstraint(),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	for _, method := range InvoiceOnlyMethods {
+		err := checkMacaroon(newMac, AllowChecker(method))
+		if err != nil {
+			t.Fatalf("%s rejected: %v", method, err)
+		}
+	}
+	for _, method := range []string{"sendpayment", "sendcoins"} {
+		err := checkMacaroon(newMac, AllowChecker(method))
+		if err == nil {
+			t.Fatalf("%s accepted", method)
+		}
+	}
+}
+
+// TestNoCloseConstraint tests that a no-close macaroon can open channels but
+// not close them.
+func TestNoCloseConstraint(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), NoCloseConstraint(),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	err = checkMacaroon(newMac, AllowChecker("openchannel"))
+	if err != nil {
+		t.Fatalf("openchannel rejected: %v", err)
+	}
+	for _, method := range CloseChannelMethods {
+		err := checkMacaroon(newMac, AllowChecker(method))
+		if err == nil {
+			t.Fatalf("%s accepted", method)
+		}
+	}
+}
+
+// TestClientCertConstraint tests that a macaroon bound to a client
+// certificate only validates for a matching fingerprint.
+func TestClientCertConstraint(t *testing.T) {
+	certHash := sha256.Sum256([]byte("client cert"))
+	fingerprint := hex.EncodeToString(certHash[:])
+	otherHash := sha256.Sum256([]byte("other cert"))
+
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, ClientCertConstraint("abcd"))
+	if err == nil {
+		t.Fatalf("short fingerprint should be rejected")
+	}
+
+	// Fingerprints are compared by their decoded value, so case must not
+	// matter.
+	newMac, err := AddConstraints(
+		mac, ClientCertConstraint(strings.ToUpper(fingerprint)),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	err = checkMacaroon(newMac, ClientCertChecker(fingerprint))
+	if err != nil {
+		t.Fatalf("matching fingerprint rejected: %v", err)
+	}
+	err = checkMacaroon(
+		newMac, ClientCertChecker(hex.EncodeToString(otherHash[:])),
+	)
+	if err == nil {
+		t.Fatalf("different fingerprint accepted")
+	}
+}
+
+// TestTLSSessionConstraint tests that a macaroon is only valid over the TLS
+// session it's bound to.
+func TestTLSSessionConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, TLSSessionConstraint(nil))
+	if err == nil {
+		t.Fatalf("empty session id should be rejected")
+	}
+
+	sessionID := []byte("session one")
+	newMac, err := AddConstraints(mac, TLSSessionConstraint(sessionID))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	err = checkMacaroon(newMac, TLSSessionChecker(sessionID))
+	if err != nil {
+		t.Fatalf("matching session rejected: %v", err)
+	}
+	otherIDs := [][]byte{nil, []byte("session two"), []byte("session")}
+	for _, otherID := range otherIDs {
+		err := checkMacaroon(newMac, TLSSessionChecker(otherID))
+		if err == nil {
+			t.Fatalf("session %q accepted", otherID)
+		}
+	}
+}
+
+// TestMaxValueConstraints tests that every constraint capping a value rejects
+// non-positive caps, bakes the cap into its caveat and accepts values up to
+// and including it, while malformed caveats are rejected.
+func TestMaxValueConstraints(t *testing.T) {
+	tests := []struct {
+		cond       string
+		constraint func(int64) Constraint
+		checker    func(int64) checkers.Checker
+	}{
+		{
+			CondMaxChannelCapacity,
+			func(n int64) Constraint {
+				return MaxChannelCapacityConstraint(n)
+			},
+			MaxChannelCapacityChecker,
+		},
+		{
+			CondMaxFeeRate,
+			func(n int64) Constraint {
+				return MaxFeeRateConstraint(n)
+			},
+			MaxFeeRateChecker,
+		},
+		{
+			CondMaxCLTV,
+			func(n int64) Constraint {
+				return MaxCLTVConstraint(int(n))
+			},
+			func(n int64) checkers.Checker {
+				return MaxCLTVChecker(int(n))
+			},
+		},
+		{
+			CondMaxPage,
+			func(n int64) Constraint {
+				return MaxPageSizeConstraint(int(n))
+			},
+			func(n int64) checkers.Checker {
+				return MaxPageSizeChecker(int(n))
+			},
+		},
+		{
+			CondMaxPeers,
+			func(n int64) Constraint {
+				return MaxPeersConstraint(int(n))
+			},
+			func(n int64) checkers.Checker {
+				return MaxPeersChecker(int(n))
+			},
+		},
+		{
+			CondLiquidityLimit,
+			func(n int64) Constraint {
+				return LiquidityLimitConstraint(n)
+			},
+			LiquidityLimitChecker,
+		},
+	}
+
+	const max = 100
+	for _, test := range tests {
+		mac := createDummyMacaroon(t)
+		for _, n := range []int64{0, -1} {
+			_, err := AddConstraints(mac, test.constraint(n))
+			if err == nil {
+				t.Fatalf("%s: cap of %d should be rejected",
+					test.cond, n)
+			}
+		}
+
+		newMac, err := AddConstraints(mac, test.constraint(max))
+		if err != nil {
+			t.Fatalf("%s: Error adding constraint: %v", test.cond,
+				err)
+		}
+		expected := fmt.Sprintf("%s %d", test.cond, max)
+		if caveat := newMac.Caveats()[0].Id; caveat != expected {
+			t.Fatalf("%s: unexpected caveat %q", test.cond, caveat)
+		}
+		for _, n := range []int64{0, 1, max - 1, max, max + 1, 10000} {
+			err := checkMacaroon(newMac, test.checker(n))
+			if n <= max && err != nil {
+				t.Fatalf("%s: %d rejected: %v", test.cond, n,
+					err)
+			}
+			if n > max && err == nil {
+				t.Fatalf("%s: %d accepted", test.cond, n)
+			}
+		}
+
+		for _, arg := range []string{"", " 5.5", " x"} {
+			malformed := createDummyMacaroon(t)
+			caveat := test.cond + arg
+			err := malformed.AddFirstPartyCaveat(caveat)
+			if err != nil {
+				t.Fatalf("Error adding caveat: %v", err)
+			}
+			err = checkMacaroon(malformed, test.checker(1))
+			if err == nil {
+				t.Fatalf("malformed caveat %q accepted", caveat)
+			}
+		}
+	}
+}
+
+// TestScheduleConstraint tests that a macaroon restricted to a weekly schedule
+// is only valid within it, including windows that wrap past midnight.
+func TestScheduleConstraint(t *testing.T) {
+	weekdays := []time.Weekday{
+		time.Monday, time.Tuesday, time.Wednesday, time.Thursday,
+		time.Friday,
+	}
+	mac := createDummyMacaroon(t)
+
+	badSchedules := []struct {
+		days       []time.Weekday
+		start, end time.Duration
+	}{
+		{nil, 9 * time.Hour, 17 * time.Hour},
+		{weekdays, 9 * time.Hour, 9 * time.Hour},
+		{weekdays, -time.Hour, 17 * time.Hour},
+		{weekdays, 9 * time.Hour, 24 * time.Hour},
+		{[]time.Weekday{7}, 9 * time.Hour, 17 * time.Hour},
+	}
+	for _, s := range badSchedules {
+		constraint := ScheduleConstraint(s.days, s.start, s.end)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("schedule %v should be rejected", s)
+		}
+	}
+
+	// Monday to Friday, 09:00 to 17:00.
+	officeHours, err := AddConstraints(
+		mac, ScheduleConstraint(weekdays, 9*time.Hour, 17*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	// Fridays and Saturdays, 22:00 to 02:00.
+	nights, err := AddConstraints(mac, ScheduleConstraint(
+		[]time.Weekday{time.Saturday, time.Friday, time.Friday},
+		22*time.Hour, 2*time.Hour,
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if nights.Caveats()[0].Id != "schedule 5,6 79200 7200" {
+		t.Fatalf("unexpected caveat %q", nights.Caveats()[0].Id)
+	}
+
+	// October 9th 2017 is a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2017, 10, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		mac   *macaroon.Macaroon
+		now   time.Time
+		valid bool
+	}{
+		{officeHours, at(9, 9, 0), true},
+		{officeHours, at(13, 16, 59), true},
+		{officeHours, at(13, 17, 0), false},
+		{officeHours, at(10, 8, 59), false},
+		{officeHours, at(14, 12, 0), false},
+		{nights, at(13, 23, 0), true},
+		{nights, at(14, 1, 0), true},
+		{nights, at(15, 1, 0), true},
+		{nights, at(13, 1, 0), false},
+		{nights, at(16, 1, 0), false},
+		{nights, at(14, 12, 0), false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(test.mac, ScheduleChecker(test.now))
+		if test.valid && err != nil {
+			t.Fatalf("%v rejected: %v", test.now, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%v accepted", test.now)
+		}
+	}
+}
+
+// TestNonceConstraint tests that a nonce is only accepted until the server
+// has observed it.
+func TestNonceConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if _, err := AddConstraints(mac, NonceConstraint("")); err == nil {
+		t.Fatalf("empty nonce should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, NonceConstraint("abc123"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	seenNonces := make(map[string]bool)
+	seen := func(nonce string) bool {
+		if seenNonces[nonce] {
+			return true
+		}
+		seenNonces[nonce] = true
+		return false
+	}
+	if err := checkMacaroon(newMac, NonceChecker(seen)); err != nil {
+		t.Fatalf("fresh nonce rejected: %v", err)
+	}
+	if err := checkMacaroon(newMac, NonceChecker(seen)); err == nil {
+		t.Fatalf("replayed nonce accepted")
+	}
+}
+
+// TestDelegationDepthConstraint tests that a chain of delegations is rejected
+// once it grows deeper than allowed.
+func TestDelegationDepthConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, DelegationDepthConstraint(-1))
+	if err == nil {
+		t.Fatalf("negative depth should be rejected")
+	}
+
+	chain := []*macaroon.Macaroon{mac}
+	current, err := AddConstraints(mac, DelegationDepthConstraint(2))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		current, err = Delegate(current, AllowConstraint("GetInfo"))
+		if err != nil {
+			t.Fatalf("Error delegating macaroon: %v", err)
+		}
+		chain = append(chain, current)
+	}
+
+	for depth, mac := range chain {
+		current, err := DelegationDepth(mac)
+		if err != nil {
+			t.Fatalf("Error computing depth: %v", err)
+		}
+		if current != depth {
+			t.Fatalf("expected depth %d, got %d", depth, current)
+		}
+
+		err = checkMacaroon(
+			mac, DelegationDepthChecker(current),
+			AllowChecker("GetInfo"),
+		)
+		if depth <= 2 && err != nil {
+			t.Fatalf("depth %d rejected: %v", depth, err)
+		}
+		if depth > 2 && err == nil {
+			t.Fatalf("depth %d accepted", depth)
+		}
+	}
+
+	// Adding a lower depth caveat by hand mustn't reset the depth.
+	if err := current.AddFirstPartyCaveat("depth 0"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if depth, _ := DelegationDepth(current); depth != 3 {
+		t.Fatalf("expected depth 3, got %d", depth)
+	}
+
+	// Applied midway through a chain, the constraint only counts the
+	// delegations that follow.
+	mid, err := Delegate(mac, AllowConstraint("GetInfo"))
+	if err != nil {
+		t.Fatalf("Error delegating macaroon: %v", err)
+	}
+	mid, err = Delegate(mid)
+	if err != nil {
+		t.Fatalf("Error delegating macaroon: %v", err)
+	}
+	mid, err = AddConstraints(mid, DelegationDepthConstraint(1))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	for i, expectOK := range []bool{true, true, false} {
+		depth, err := DelegationDepth(mid)
+		if err != nil {
+			t.Fatalf("Error computing depth: %v", err)
+		}
+		err = checkMacaroon(
+			mid, DelegationDepthChecker(depth),
+			AllowChecker("GetInfo"),
+		)
+		if expectOK && err != nil {
+			t.Fatalf("%d further delegations rejected: %v", i, err)
+		}
+		if !expectOK && err == nil {
+			t.Fatalf("%d further delegations accepted", i)
+		}
+		if mid, err = Delegate(mid); err != nil {
+			t.Fatalf("Error delegating macaroon: %v", err)
+		}
+	}
+}
+
+// TestAccountConstraint tests that a macaroon restricted to an account
+// rejects requests for any other account.
+func TestAccountConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if _, err := AddConstraints(mac, AccountConstraint("")); err == nil {
+		t.Fatalf("empty account should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, AccountConstraint("savings"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if err := checkMacaroon(newMac, AccountChecker("savings")); err != nil {
+		t.Fatalf("matching account rejected: %v", err)
+	}
+	for _, account := range []string{"default", ""} {
+		err := checkMacaroon(newMac, AccountChecker(account))
+		if err == nil {
+			t.Fatalf("account %q accepted", account)
+		}
+	}
+}
+
+// TestFundingAccountConstraint tests that transactions may only be funded from
+// the account locked in the macaroon.
+func TestFundingAccountConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, FundingAccountConstraint(""))
+	if err == nil {
+		t.Fatalf("empty account should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, FundingAccountConstraint("hot"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(newMac, FundingAccountChecker("hot"))
+	if err != nil {
+		t.Fatalf("matching account rejected: %v", err)
+	}
+	for _, account := range []string{"cold", "Hot", ""} {
+		err := checkMacaroon(newMac, FundingAccountChecker(account))
+		if err == nil {
+			t.Fatalf("account %q accepted", account)
+		}
+	}
+
+	// The account operated on doesn't satisfy the funding account.
+	err = checkMacaroon(newMac, AccountChecker("hot"))
+	if err == nil {
+		t.Fatalf("funding account caveat checked as account")
+	}
+}
+
+// TestAttestationConstraint tests that an attestation is only accepted if its
+// signature verifies against the attestation key.
+func TestAttestationConstraint(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	otherPubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	payload := []byte("device attested at 2017-10-06")
+	sig := ed25519.Sign(privKey, payload)
+
+	mac := createDummyMacaroon(t)
+	_, err = AddConstraints(mac, AttestationConstraint(payload, sig[:10]))
+	if err == nil {
+		t.Fatalf("truncated signature should be rejected")
+	}
+	empty := AttestationConstraint(nil, ed25519.Sign(privKey, nil))
+	if _, err := AddConstraints(mac, empty); err == nil {
+		t.Fatalf("empty payload should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, AttestationConstraint(payload, sig))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(newMac, AttestationChecker(pubKey))
+	if err != nil {
+		t.Fatalf("valid attestation rejected: %v", err)
+	}
+	err = checkMacaroon(newMac, AttestationChecker(otherPubKey))
+	if err == nil {
+		t.Fatalf("attestation accepted for a different key")
+	}
+
+	forged, err := AddConstraints(
+		mac, AttestationConstraint([]byte("forged payload"), sig),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(forged, AttestationChecker(pubKey))
+	if err == nil {
+		t.Fatalf("forged attestation accepted")
+	}
+}
+
+// TestMinConfsConstraint tests that funding requests asking for fewer
+// confirmations than the policy are rejected.
+func TestMinConfsConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if _, err := AddConstraints(mac, MinConfsConstraint(-1)); err == nil {
+		t.Fatalf("negative confirmations should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, MinConfsConstraint(3))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	for confs := 0; confs <= 4; confs++ {
+		err := checkMacaroon(newMac, MinConfsChecker(confs))
+		if confs >= 3 && err != nil {
+			t.Fatalf("%d confirmations rejected: %v", confs, err)
+		}
+		if confs < 3 && err == nil {
+			t.Fatalf("%d confirmations accepted", confs)
+		}
+	}
+}
+
+// TestAddConstraintsError tests that the error of a failing constraint is
+// wrapped with its position, and with its kind for the constraints of the
+// package.
+func TestAddConstraintsError(t *testing.T) {
+	errBroken := fmt.Errorf("broken constraint")
+	broken := func(*macaroon.Macaroon) error {
+		return errBroken
+	}
+
+	_, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		TimeoutConstraint(60), broken, IPLockConstraint("10.0.0.1"),
+	)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expected broken constraint error, got %v", err)
+	}
+	expected := "constraint 2 failed: broken constraint"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+
+	tests := []struct {
+		constraint Constraint
+		expected   string
+	}{
+		{IPLockConstraint("nowhere"), "constraint 1 (client-ip-addr) " +
+			"failed: incorrect macaroon IP-lock address"},
+		{MaxPageSizeConstraint(0), "constraint 1 (max-page) failed: " +
+			"max-page must be positive, got 0"},
+		{MinChannelAgeConstraint(-1), "constraint 1 (min-chan-age) " +
+			"failed: "},
+		{StructConstraint("", nil), "constraint 1 failed: "},
+		{OrConstraint(MinConfsConstraint(-1)), "constraint 1 (or) " +
+			"failed: "},
+		{IPLockConstraint("10.*.0.*"), "constraint 1 " +
+			"(client-ip-range) failed: invalid wildcard IP"},
+		{IPLockConstraint("10.0.0.0/33"), "constraint 1 " +
+			"(client-ip-range) failed: invalid IP range"},
+	}
+	for _, test := range tests {
+		_, err := AddConstraints(
+			createDummyMacaroon(t), TimeoutConstraint(60),
+			test.constraint,
+		)
+		if err == nil ||
+			!strings.HasPrefix(err.Error(), test.expected) {
+
+			t.Fatalf("expected error %q, got %v", test.expected,
+				err)
+		}
+	}
+}
+
+// TestSkipDuplicates tests that re-applying a caveat the macaroon already
+// carries doesn't add it again, while new caveats are still added.
+func TestSkipDuplicates(t *testing.T) {
+	mac, err := AddConstraints(
+		createDummyMacaroon(t), TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	// TimeoutConstraint computes its expiry when applied, so re-apply
+	// the exact caveat it produced to get the same expiry.
+	expiry := mac.Caveats()[0].Id
+	sameTimeout := func(mac *macaroon.Macaroon) error {
+		return mac.AddFirstPartyCaveat(expiry)
+	}
+
+	newMac, err := AddConstraints(mac, SkipDuplicates(
+		sameTimeout, AllowConstraint("GetInfo"), sameTimeout,
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	if n := len(newMac.Caveats()); n != 2 {
+		t.Fatalf("expected 2 caveats, got %d", n)
+	}
+	err = checkMacaroon(newMac, AllowChecker("GetInfo"), TimeoutChecker())
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	// Without the wrapper the duplicate is added as usual.
+	newMac, err = AddConstraints(mac, sameTimeout)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if n := len(newMac.Caveats()); n != 2 {
+		t.Fatalf("expected 2 caveats, got %d", n)
+	}
+}
+
+// TestRelocate tests that a relocated macaroon keeps its id and caveats and
+// still verifies, and that it can only be re-baked with the right root key.
+func TestRelocate(t *testing.T) {
+	mac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	if _, err := Relocate(mac, []byte("wrong key"), "lnd2"); err == nil {
+		t.Fatalf("macaroon relocated with the wrong root key")
+	}
+
+	newMac, err := Relocate(mac, testRootKey, "lnd2")
+	if err != nil {
+		t.Fatalf("Error relocating macaroon: %v", err)
+	}
+	if newMac.Location() != "lnd2" || newMac.Id() != mac.Id() {
+		t.Fatalf("expected id %q at lnd2, got id %q at %q", mac.Id(),
+			newMac.Id(), newMac.Location())
+	}
+	if !reflect.DeepEqual(newMac.Caveats(), mac.Caveats()) {
+		t.Fatalf("expected caveats %v, got %v", mac.Caveats(),
+			newMac.Caveats())
+	}
+	err = checkMacaroon(
+		newMac, AllowChecker("GetInfo"), IPLockChecker("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying relocated macaroon: %v", err)
+	}
+
+	err = mac.AddThirdPartyCaveat([]byte("key"), "revoked?", "revoker")
+	if err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if _, err := Relocate(mac, testRootKey, "lnd2"); err == nil {
+		t.Fatalf("third-party caveat relocated")
+	}
+}
+
+// TestMinimalFor tests that a minimal macaroon authorizes the request it was
+// minted for, and no other method or client.
+func TestMinimalFor(t *testing.T) {
+	badCtxs := []RequestContext{
+		{ClientIP: "10.0.0.1"},
+		{Method: "getinfo", ClientIP: "nowhere"},
+	}
+	for _, ctx := range badCtxs {
+		if _, err := MinimalFor(testRootKey, ctx); err == nil {
+			t.Fatalf("request %+v should be rejected", ctx)
+		}
+	}
+
+	ctx := RequestContext{Method: "getinfo", ClientIP: "10.0.0.1"}
+	mac, err := MinimalFor(testRootKey, ctx)
+	if err != nil {
+		t.Fatalf("Error minting macaroon: %v", err)
+	}
+	other, err := MinimalFor(testRootKey, ctx)
+	if err != nil {
+		t.Fatalf("Error minting macaroon: %v", err)
+	}
+	if mac.Id() == other.Id() {
+		t.Fatalf("minted macaroons share id %q", mac.Id())
+	}
+
+	if _, err := VerifyAndInspect(mac, testRootKey, ctx); err != nil {
+		t.Fatalf("minted macaroon rejected: %v", err)
+	}
+	others := []RequestContext{
+		{Method: "sendpayment", ClientIP: "10.0.0.1"},
+		{Method: "getinfo", ClientIP: "10.0.0.2"},
+	}
+	for _, other := range others {
+		_, err := VerifyAndInspect(mac, testRootKey, other)
+		if err == nil {
+			t.Fatalf("request %+v accepted", other)
+		}
+	}
+
+	// Without a client IP, the macaroon is only restricted to the method.
+	mac, err = MinimalFor(testRootKey, RequestContext{Method: "getinfo"})
+	if err != nil {
+		t.Fatalf("Error minting macaroon: %v", err)
+	}
+	if n := len(mac.Caveats()); n != 1 {
+		t.Fatalf("expected 1 caveat, got %d", n)
+	}
+}
+
+// TestMinify tests that minifying a macaroon drops its labels while keeping
+// every enforcing caveat, along with the informational caveats they rely on.
+func TestMinify(t *testing.T) {
+	mac, err := AddConstraints(
+		createDummyMacaroon(t), LabelConstraint("ci"),
+		AllowConstraint("GetInfo"), IPLockConstraint("10.0.0.1"),
+		DelegationDepthConstraint(1), LabelConstraint("nightly"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	mac, err = Delegate(mac)
+	if err != nil {
+		t.Fatalf("Error delegating macaroon: %v", err)
+	}
+
+	if _, err := Minify(mac, []byte("wrong key")); err == nil {
+		t.Fatalf("macaroon minified with the wrong root key")
+	}
+
+	newMac, err := Minify(mac, testRootKey)
+	if err != nil {
+		t.Fatalf("Error minifying macaroon: %v", err)
+	}
+	if newMac.Location() != mac.Location() || newMac.Id() != mac.Id() {
+		t.Fatalf("minified macaroon has a different id or location")
+	}
+	var caveats []string
+	for _, caveat := range newMac.Caveats() {
+		caveats = append(caveats, caveat.Id)
+	}
+	expected := []string{
+		"allow GetInfo", "client-ip-addr 10.0.0.1", "max-depth 1",
+		"depth 1",
+	}
+	if !reflect.DeepEqual(caveats, expected) {
+		t.Fatalf("expected caveats %v, got %v", expected, caveats)
+	}
+	err = checkMacaroon(
+		newMac, AllowChecker("GetInfo"), IPLockChecker("10.0.0.1"),
+		DelegationDepthChecker(1),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying minified macaroon: %v", err)
+	}
+}
+
+// TestScopeConstraint tests that methods are checked against the scopes of the
+// macaroon as resolved at verification time.
+func TestScopeConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, scopes := range [][]string{nil, {""}, {"read only"}} {
+		constraint := ScopeConstraint(scopes...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("scopes %q should be rejected", scopes)
+		}
+	}
+
+	scopes := map[string][]string{
+		"readonly": {"getinfo", "listchannels"},
+		"invoice":  {"addinvoice", "readinvoices"},
+		"admin":    {"sendpayment", "getinfo"},
+	}
+	resolve := func(scope string) []string {
+		return scopes[scope]
+	}
+
+	newMac, err := AddConstraints(
+		mac, ScopeConstraint("readonly", "invoice", "unknown"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	tests := []struct {
+		method string
+		valid  bool
+	}{
+		{"getinfo", true},
+		{"addinvoice", true},
+		{"sendpayment", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, ScopeChecker(resolve, test.method))
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.method, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.method)
+		}
+	}
+
+	// Narrowing the scopes further intersects them.
+	narrowed, err := AddConstraints(newMac, ScopeConstraint("admin"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(narrowed, ScopeChecker(resolve, "getinfo"))
+	if err != nil {
+		t.Fatalf("getinfo rejected: %v", err)
+	}
+	err = checkMacaroon(narrowed, ScopeChecker(resolve, "addinvoice"))
+	if err == nil {
+		t.Fatalf("addinvoice accepted")
+	}
+}
+
+// TestCategoryConstraint tests that methods are checked against the categories
+// of the macaroon as resolved at verification time.
+func TestCategoryConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, cats := range [][]string{nil, {""}, {"wallet ops"}} {
+		constraint := CategoryConstraint(cats...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("categories %q should be rejected", cats)
+		}
+	}
+
+	categories := map[string]string{
+		"newaddress":  "wallet",
+		"sendcoins":   "wallet",
+		"openchannel": "channels",
+		"connectpeer": "peers",
+	}
+	category := func(method string) string {
+		return categories[method]
+	}
+
+	newMac, err := AddConstraints(
+		mac, CategoryConstraint("wallet", "peers"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	tests := []struct {
+		method string
+		valid  bool
+	}{
+		{"newaddress", true},
+		{"connectpeer", true},
+		{"openchannel", false},
+		{"stopdaemon", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(
+			newMac, CategoryChecker(test.method, category),
+		)
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.method, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.method)
+		}
+	}
+
+	// Narrowing the categories further intersects them.
+	narrowed, err := AddConstraints(newMac, CategoryConstraint("peers"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(narrowed, CategoryChecker("sendcoins", category))
+	if err == nil {
+		t.Fatalf("sendcoins accepted")
+	}
+}
+
+// TestSessionConstraint tests that a macaroon is only valid while its session
+// is active.
+func TestSessionConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if _, err := AddConstraints(mac, SessionConstraint("")); err == nil {
+		t.Fatalf("empty session should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, SessionConstraint("cli-1234"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	sessions := map[string]bool{"cli-1234": true}
+	active := func(id string) bool {
+		return sessions[id]
+	}
+	if err := checkMacaroon(newMac, SessionChecker(active)); err != nil {
+		t.Fatalf("active session rejected: %v", err)
+	}
+
+	delete(sessions, "cli-1234")
+	if err := checkMacaroon(newMac, SessionChecker(active)); err == nil {
+		t.Fatalf("ended session accepted")
+	}
+}
+
+// TestDailyUseConstraint tests that a macaroon is only usable once per UTC
+// day, including across midnight and for times in other time zones.
+func TestDailyUseConstraint(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), DailyUseConstraint(),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	// 01:00 in UTC+2 is still the previous day in UTC.
+	tz := time.FixedZone("UTC+2", 2*60*60)
+	beforeMidnight := time.Date(2017, 10, 9, 23, 59, 0, 0, time.UTC)
+	tests := []struct {
+		lastUsed time.Time
+		now      time.Time
+		valid    bool
+	}{
+		{time.Time{}, beforeMidnight, true},
+		{beforeMidnight.Add(-23 * time.Hour), beforeMidnight, false},
+		{beforeMidnight, beforeMidnight.Add(time.Minute), true},
+		{beforeMidnight.Add(-24 * time.Hour), beforeMidnight, true},
+		{
+			time.Date(2017, 10, 10, 1, 0, 0, 0, tz),
+			beforeMidnight, false,
+		},
+		{
+			beforeMidnight,
+			time.Date(2017, 10, 10, 2, 30, 0, 0, tz), true,
+		},
+	}
+	for _, test := range tests {
+		checker := DailyUseChecker(test.lastUsed, test.now)
+		err := checkMacaroon(newMac, checker)
+		if test.valid && err != nil {
+			t.Fatalf("use at %v after %v rejected: %v", test.now,
+				test.lastUsed, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("use at %v after %v accepted", test.now,
+				test.lastUsed)
+		}
+	}
+}
+
+// TestRelativeExpiryConstraint tests that the macaroon expires its ttl after
+// its issued-at time, that a ttl without an issued-at time fails and that
+// attenuation can't extend the lifetime.
+func TestRelativeExpiryConstraint(t *testing.T) {
+	issued := time.Date(2017, 10, 9, 12, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(fixedClock(issued)))
+
+	mac := createDummyMacaroon(t)
+	for _, ttl := range []time.Duration{0, -time.Hour, time.Millisecond} {
+		constraint := RelativeExpiryConstraint(ttl)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("ttl of %v should be rejected", ttl)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, RelativeExpiryConstraint(time.Hour))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	tests := []struct {
+		elapsed time.Duration
+		valid   bool
+	}{
+		{0, true},
+		{59 * time.Minute, true},
+		{time.Hour, false},
+		{2 * time.Hour, false},
+	}
+	for _, test := range tests {
+		now := issued.Add(test.elapsed)
+		err := checkMacaroon(newMac, RelativeExpiryChecker(now))
+		if test.valid && err != nil {
+			t.Fatalf("macaroon rejected after %v: %v",
+				test.elapsed, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("macaroon accepted after %v", test.elapsed)
+		}
+	}
+
+	// Re-issuing the macaroon later or with a longer ttl doesn't extend
+	// its lifetime.
+	SetClock(fixedClock(issued.Add(time.Hour)))
+	extended, err := AddConstraints(
+		newMac, RelativeExpiryConstraint(24*time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	later := issued.Add(90 * time.Minute)
+	err = checkMacaroon(extended, RelativeExpiryChecker(later))
+	if err == nil {
+		t.Fatalf("attenuation extended the macaroon lifetime")
+	}
+
+	// Either caveat on its own is rejected, whether it's the only one or
+	// it's followed by a complete pair. A trailing issued-at caveat is
+	// only caught once the whole macaroon is seen.
+	issuedAt := "issued-at " + issued.Format(time.RFC3339Nano)
+	unpaired := []struct {
+		name    string
+		caveats []string
+	}{
+		{"ttl only", []string{"ttl 3600"}},
+		{"issued-at only", []string{issuedAt}},
+		{"ttl before pair", []string{"ttl 3600", issuedAt, "ttl 60"}},
+		{"issued-at before pair",
+			[]string{issuedAt, issuedAt, "ttl 3600"}},
+	}
+	for _, test := range unpaired {
+		badMac := mac.Clone()
+		for _, caveat := range test.caveats {
+			err := badMac.AddFirstPartyCaveat(caveat)
+			if err != nil {
+				t.Fatalf("Error adding caveat: %v", err)
+			}
+		}
+		ctx := RequestContext{
+			Checkers: []checkers.Checker{
+				RelativeExpiryChecker(issued),
+			},
+			MacaroonCheckers: []MacaroonChecker{
+				RelativeExpiryPairsChecker(),
+			},
+		}
+		err := NewVerifier().VerifyRequest(badMac, testRootKey, ctx)
+		if err == nil {
+			t.Fatalf("%s accepted", test.name)
+		}
+		err = RelativeExpiryPairsChecker()(badMac)
+		if err == nil {
+			t.Fatalf("%s accepted by pairs checker", test.name)
+		}
+	}
+	if err := RelativeExpiryPairsChecker()(extended); err != nil {
+		t.Fatalf("paired caveats rejected: %v", err)
+	}
+}
+
+// TestFiatLimitConstraint tests that spending is capped in the currency the
+// limit was set in, and that malformed limits are rejected.
+func TestFiatLimitConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	invalid := []struct {
+		currency string
+		cents    int64
+	}{
+		{"", 100},
+		{"US", 100},
+		{"USDT", 100},
+		{"U2D", 100},
+		{"USD", -1},
+	}
+	for _, test := range invalid {
+		constraint := FiatLimitConstraint(test.currency, test.cents)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("limit of %d %s should be rejected",
+				test.cents, test.currency)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, FiatLimitConstraint("usd", 500))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		currency string
+		spent    int64
+		valid    bool
+	}{
+		{"USD", 0, true},
+		{"USD", 500, true},
+		{"usd", 499, true},
+		{"USD", 501, false},
+		{"EUR", 100, false},
+	}
+	for _, test := range tests {
+		checker := FiatLimitChecker(test.currency, test.spent)
+		err := checkMacaroon(newMac, checker)
+		if test.valid && err != nil {
+			t.Fatalf("spending %d %s rejected: %v", test.spent,
+				test.currency, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("spending %d %s accepted", test.spent,
+				test.currency)
+		}
+	}
+}
+
+// TestStreamModeConstraint tests that each mode only lets through the kind of
+// calls it allows.
+func TestStreamModeConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, StreamModeConstraint(Mode(7)))
+	if err == nil {
+		t.Fatalf("unknown mode should be rejected")
+	}
+
+	tests := []struct {
+		mode   Mode
+		unary  bool
+		stream bool
+	}{
+		{Any, true, true},
+		{Unary, true, false},
+		{Stream, false, true},
+	}
+	for _, test := range tests {
+		constraint := StreamModeConstraint(test.mode)
+		newMac, err := AddConstraints(mac, constraint)
+		if err != nil {
+			t.Fatalf("Error adding constraint: %v", err)
+		}
+		if test.mode == Any && len(newMac.Caveats()) != 0 {
+			t.Fatalf("any mode shouldn't add a caveat")
+		}
+
+		for isStream, valid := range map[bool]bool{
+			false: test.unary,
+			true:  test.stream,
+		} {
+			checker := StreamModeChecker(isStream)
+			err := checkMacaroon(newMac, checker)
+			if valid && err != nil {
+				t.Fatalf("%v macaroon rejected stream=%v: %v",
+					test.mode, isStream, err)
+			}
+			if !valid && err == nil {
+				t.Fatalf("%v macaroon accepted stream=%v",
+					test.mode, isStream)
+			}
+		}
+	}
+}
+
+// TestMaxStreamsConstraint tests that streams may be opened until the cap is
+// reached, and that non-positive caps are rejected. Unlike the caps covered by
+// TestMaxValueConstraints, the checker is given the number of streams already
+// open, so reaching the cap is enough to be rejected.
+func TestMaxStreamsConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, n := range []int{0, -1} {
+		constraint := MaxStreamsConstraint(n)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("cap of %d should be rejected", n)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, MaxStreamsConstraint(5))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if caveat := newMac.Caveats()[0].Id; caveat != "max-streams 5" {
+		t.Fatalf("unexpected caveat %q", caveat)
+	}
+	for _, open := range []int{0, 4, 5, 6} {
+		err := checkMacaroon(newMac, MaxStreamsChecker(open))
+		if open < 5 && err != nil {
+			t.Fatalf("stream with %d open rejected: %v", open, err)
+		}
+		if open >= 5 && err == nil {
+			t.Fatalf("stream with %d open accepted", open)
+		}
+	}
+}
+
+// TestAllowedAddressConstraint tests that sends are only allowed to the
+// addresses in the set.
+func TestAllowedAddressConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, addrs := range [][]string{nil, {""}, {"bc1q abc"}} {
+		constraint := AllowedAddressConstraint(addrs...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("addresses %q should be rejected", addrs)
+		}
+	}
+
+	const (
+		cold = "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"
+		hot  = "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"
+	)
+	newMac, err := AddConstraints(mac, AllowedAddressConstraint(cold, hot))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{cold, true},
+		{hot, true},
+		{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, AllowedAddressChecker(test.addr))
+		if test.valid && err != nil {
+			t.Fatalf("sending to %q rejected: %v", test.addr, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("sending to %q accepted", test.addr)
+		}
+	}
+}
+
+// TestVelocityConstraint tests that spending within the window is accepted up
+// to and including the cap, and that non-positive policies are rejected.
+func TestVelocityConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	invalid := []struct {
+		sat    int64
+		window time.Duration
+	}{
+		{0, time.Hour},
+		{-1, time.Hour},
+		{1000, 0},
+		{1000, -time.Hour},
+		{1000, time.Millisecond},
+	}
+	for _, test := range invalid {
+		constraint := VelocityConstraint(test.sat, test.window)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("%d sat per %v should be rejected", test.sat,
+				test.window)
+		}
+	}
+
+	const btc = 100000000
+	newMac, err := AddConstraints(mac, VelocityConstraint(btc, time.Hour))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	caveat := newMac.Caveats()[0].Id
+	if caveat != "velocity 100000000 3600" {
+		t.Fatalf("unexpected caveat %q", caveat)
+	}
+	for _, spent := range []int64{0, btc - 1, btc, btc + 1} {
+		err := checkMacaroon(newMac, VelocityChecker(spent))
+		if spent <= btc && err != nil {
+			t.Fatalf("spending %d rejected: %v", spent, err)
+		}
+		if spent > btc && err == nil {
+			t.Fatalf("spending %d accepted", spent)
+		}
+	}
+}
+
+// TestAllowRegexConstraint tests that only methods matching one of the
+// patterns are allowed, and that broken patterns are caught when baking.
+func TestAllowRegexConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, patterns := range [][]string{nil, {"^(List"}} {
+		constraint := AllowRegexConstraint(patterns...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("patterns %v should be rejected", patterns)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, AllowRegexConstraint(
+		`^/lnrpc\.Lightning/(List|Get).*$`,
+		`^/lnrpc\.Lightning/Add Invoice$`,
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		valid  bool
+	}{
+		{"/lnrpc.Lightning/ListChannels", true},
+		{"/lnrpc.Lightning/GetInfo", true},
+		{"/lnrpc.Lightning/Add Invoice", true},
+		{"/lnrpc.Lightning/SendPayment", false},
+		{"/lnrpc.LightningXListChannels", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, AllowRegexChecker(test.method))
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.method, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.method)
+		}
+	}
+}
+
+// TestConstraintsSerializationRoundTrip tests that every constraint offered by
+// the package produces caveats that survive cloning and a binary round trip
+// unchanged, and that the decoded macaroon still verifies. It fails if any
+// condition known to the package isn't covered by one of the cases.
+func TestConstraintsSerializationRoundTrip(t *testing.T) {
+	certHash := sha256.Sum256([]byte("client cert"))
+	fingerprint := hex.EncodeToString(certHash[:])
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	payload := []byte("payload")
+	weekdays := []time.Weekday{time.Monday}
+	monday := time.Date(2017, 10, 9, 12, 0, 0, 0, time.UTC)
+	onion := strings.Repeat("abcdefg234567", 5)[:56] + ".onion"
+	path := []string{testNodeID(1), testNodeID(2)}
+	category := func(string) string { return "info" }
+	operator := func(node string) string { return node }
+	scope := func(string) []string { return []string{"GetInfo"} }
+	active := func(string) bool { return true }
+	unseen := func(string) bool { return false }
+	accept := func(json.RawMessage) error { return nil }
+	policy := testPolicy{Hosts: []string{"a.example.com"}, MaxUsers: 3}
+
+	tests := []struct {
+		name       string
+		method     string
+		constraint Constraint
+		checkers   []checkers.Checker
+	}{
+		{"allow", "GetInfo", AllowConstraint("GetInfo"), nil},
+		{"invoice only", "addinvoice", InvoiceOnlyConstraint(), nil},
+		{"no close", "GetInfo", NoCloseConstraint(), nil},
+		{"timeout", "GetInfo", TimeoutConstraint(60), nil},
+		{"ip lock", "GetInfo", IPLockConstraint("10.0.0.1"), nil},
+		{"ip range", "GetInfo", IPRangeConstraint("10.0.0.0/8"), nil},
+		{"all ips", "GetInfo", RequireAllIPsConstraint("10.0.0.1"),
+			[]checkers.Checker{
+				RequireAllIPsChecker([]string{"10.0.0.1"}),
+			}},
+		{"client cert", "GetInfo", ClientCertConstraint(fingerprint),
+			[]checkers.Checker{ClientCertChecker(fingerprint)}},
+		{"tls session", "GetInfo", TLSSessionConstraint([]byte("s")),
+			[]checkers.Checker{TLSSessionChecker([]byte("s"))}},
+		{"channel capacity", "GetInfo",
+			MaxChannelCapacityConstraint(1000),
+			[]checkers.Checker{MaxChannelCapacityChecker(1000)}},
+		{"fee rate", "GetInfo", MaxFeeRateConstraint(50),
+			[]checkers.Checker{MaxFeeRateChecker(10)}},
+		{"cltv", "GetInfo", MaxCLTVConstraint(144),
+			[]checkers.Checker{MaxCLTVChecker(40)}},
+		{"streams", "GetInfo", MaxStreamsConstraint(2),
+			[]checkers.Checker{MaxStreamsChecker(1)}},
+		{"page size", "GetInfo", MaxPageSizeConstraint(100),
+			[]checkers.Checker{MaxPageSizeChecker(10)}},
+		{"peers", "GetInfo", MaxPeersConstraint(8),
+			[]checkers.Checker{MaxPeersChecker(3)}},
+		{"liquidity", "GetInfo", LiquidityLimitConstraint(1000),
+			[]checkers.Checker{LiquidityLimitChecker(10)}},
+		{"schedule", "GetInfo",
+			ScheduleConstraint(weekdays, 9*time.Hour, 17*time.Hour),
+			[]checkers.Checker{ScheduleChecker(monday)}},
+		{"nonce", "GetInfo", NonceConstraint("nonce"),
+			[]checkers.Checker{NonceChecker(unseen)}},
+		{"delegation depth", "GetInfo", DelegationDepthConstraint(1),
+			nil},
+		{"account", "GetInfo", AccountConstraint("savings"),
+			[]checkers.Checker{AccountChecker("savings")}},
+		{"funding account", "GetInfo", FundingAccountConstraint("cold"),
+			[]checkers.Checker{FundingAccountChecker("cold")}},
+		{"attestation", "GetInfo",
+			AttestationConstraint(
+				payload, ed25519.Sign(privKey, payload),
+			),
+			[]checkers.Checker{AttestationChecker(pubKey)}},
+		{"min confs", "GetInfo", MinConfsConstraint(1),
+			[]checkers.Checker{MinConfsChecker(1)}},
+		{"allow regex", "GetInfo", AllowRegexConstraint("^Get"),
+			[]checkers.Checker{AllowRegexChecker("GetInfo")}},
+		{"user agent", "GetInfo", UserAgentConstraint("lncli/0.3"),
+			[]checkers.Checker{UserAgentChecker("lncli/0.3")}},
+		{"fiat limit", "GetInfo", FiatLimitConstraint("USD", 1000),
+			[]checkers.Checker{FiatLimitChecker("USD", 10)}},
+		{"stream mode", "GetInfo", StreamModeConstraint(Unary),
+			[]checkers.Checker{StreamModeChecker(false)}},
+		{"allowed address", "GetInfo",
+			AllowedAddressConstraint("bc1qexample"),
+			[]checkers.Checker{
+				AllowedAddressChecker("bc1qexample"),
+			}},
+		{"velocity", "GetInfo", VelocityConstraint(1000, time.Hour),
+			[]checkers.Checker{VelocityChecker(10)}},
+		{"relative expiry", "GetInfo",
+			RelativeExpiryConstraint(time.Hour),
+			[]checkers.Checker{RelativeExpiryChecker(time.Now())}},
+		{"session", "GetInfo", SessionConstraint("cli-1234"),
+			[]checkers.Checker{SessionChecker(active)}},
+		{"label", "GetInfo", LabelConstraint("my app"),
+			[]checkers.Checker{LabelChecker()}},
+		{"daily use", "GetInfo", DailyUseConstraint(),
+			[]checkers.Checker{
+				DailyUseChecker(time.Time{}, time.Now()),
+			}},
+		{"scope", "GetInfo", ScopeConstraint("readonly"),
+			[]checkers.Checker{ScopeChecker(scope, "GetInfo")}},
+		{"category", "GetInfo", CategoryConstraint("info"),
+			[]checkers.Checker{
+				CategoryChecker("GetInfo", category),
+			}},
+		{"authority", "GetInfo", AuthorityConstraint("payments.svc"),
+			[]checkers.Checker{AuthorityChecker("payments.svc")}},
+		{"onion only", "GetInfo", OnionOnlyConstraint(),
+			[]checkers.Checker{OnionChecker(onion)}},
+		{"danger ack", "GetInfo", DangerAckConstraint(), nil},
+		{"no keysend", "GetInfo", NoKeysendConstraint(),
+			[]checkers.Checker{KeysendChecker(false)}},
+		{"discharge locations", "GetInfo",
+			AllowedDischargeLocationsConstraint("https://auth"),
+			[]checkers.Checker{
+				DischargeLocationsChecker(
+					createDummyMacaroon(t), nil,
+				),
+			}},
+		{"forbid nodes", "GetInfo",
+			ForbidNodesConstraint(testNodeID(3)),
+			[]checkers.Checker{ForbidNodesChecker(path)}},
+		{"forbid nodes from", "GetInfo",
+			ForbidNodesFromConstraint([]string{testNodeID(3)}),
+			[]checkers.Checker{ForbidNodesChecker(path)}},
+		{"destination", "GetInfo", DestinationConstraint(testNodeID(2)),
+			[]checkers.Checker{DestinationChecker(testNodeID(2))}},
+		{"outgoing channel", "GetInfo", OutgoingChannelConstraint(7),
+			[]checkers.Checker{OutgoingChannelChecker(7)}},
+		{"public only", "GetInfo", PublicChannelsOnlyConstraint(),
+			[]checkers.Checker{PublicChannelsChecker(true)}},
+		{"route score", "GetInfo", RouteScoreConstraint(0.5),
+			[]checkers.Checker{RouteScoreChecker([]float64{0.9})}},
+		{"min operators", "GetInfo", MinOperatorsConstraint(2),
+			[]checkers.Checker{
+				MinOperatorsChecker(path, operator),
+			}},
+		{"min channel age", "GetInfo", MinChannelAgeConstraint(144),
+			[]checkers.Checker{MinChannelAgeChecker([]int{1000})}},
+		{"struct", "GetInfo", StructConstraint("policy", policy),
+			[]checkers.Checker{StructChecker("policy", accept)}},
+		{"or", "GetInfo",
+			OrConstraint(
+				IPLockConstraint("10.0.0.2"),
+				AccountConstraint("a"),
+			),
+			[]checkers.Checker{
+				OrChecker(IPLockChecker("10.0.0.1"),
+					AccountChecker("a")),
+			}},
+		{"and", "GetInfo",
+			AndConstraint(
+				IPLockConstraint("10.0.0.1"),
+				AccountConstraint("a"),
+			),
+			[]checkers.Checker{
+				AndChecker(IPLockChecker("10.0.0.1"),
+					AccountChecker("a")),
+			}},
+	}
+
+	covered := make(map[string]bool)
+	for _, test := range tests {
+		newMac, err := Delegate(createDummyMacaroon(t), test.constraint)
+		if err != nil {
+			t.Fatalf("%s: Error adding constraint: %v", test.name,
+				err)
+		}
+
+		macBytes, err := newMac.Clone().MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: Error serializing macaroon: %v",
+				test.name, err)
+		}
+		decoded := &macaroon.Macaroon{}
+		if err := decoded.UnmarshalBinary(macBytes); err != nil {
+			t.Fatalf("%s: Error deserializing macaroon: %v",
+				test.name, err)
+		}
+
+		caveats, decodedCaveats := newMac.Caveats(), decoded.Caveats()
+		if len(caveats) != len(decodedCaveats) {
+			t.Fatalf("%s: expected %d caveats, got %d", test.name,
+				len(caveats), len(decodedCaveats))
+		}
+		for i := range caveats {
+			if caveats[i] != decodedCaveats[i] {
+				t.Fatalf("%s: caveat %d changed from %q to %q",
+					test.name, i, caveats[i].Id,
+					decodedCaveats[i].Id)
+			}
+			cond, _, err := parseCaveat(caveats[i].Id)
+			if err == nil {
+				covered[cond] = true
+			}
+		}
+
+		ctx := RequestContext{
+			Method:   test.method,
+			ClientIP: "10.0.0.1",
+			Checkers: append(
+				test.checkers, DelegationDepthChecker(1),
+			),
+		}
+		err = checkMacaroon(decoded, ctx.checkers()...)
+		if err != nil {
+			t.Fatalf("%s: Error verifying decoded macaroon: %v",
+				test.name, err)
+		}
+	}
+
+	for cond := range knownConditions {
+		if !covered[cond] {
+			t.Fatalf("no round trip case for %s caveats", cond)
+		}
+	}
+}
+
+// TestUserAgentConstraint tests that only the listed user agents, including
+// ones with spaces, are accepted and that prefix patterns work.
+func TestUserAgentConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, agents := range [][]string{nil, {""}, {"*"}} {
+		constraint := UserAgentConstraint(agents...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("user agents %v should be rejected", agents)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, UserAgentConstraint(
+		"Zap Desktop 0.1 (linux)", "lncli/*",
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		agent string
+		valid bool
+	}{
+		{"Zap Desktop 0.1 (linux)", true},
+		{"Zap Desktop 0.1", false},
+		{"lncli/0.3", true},
+		{"lncli", false},
+		{"curl/7.55", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, UserAgentChecker(test.agent))
+		if test.valid && err != nil {
+			t.Fatalf("%q rejected: %v", test.agent, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%q accepted", test.agent)
+		}
+	}
+}
+
+// TestConcurrentConstraintsAndCheckers tests that the same constraints and
+// checkers can be used from many goroutines at once. It's mostly meant to be
+// run with the race detector.
+func TestConcurrentConstraintsAndCheckers(t *testing.T) {
+	certHash := sha256.Sum256([]byte("client cert"))
+	fingerprint := hex.EncodeToString(certHash[:])
+	monday := time.Date(2017, 10, 9, 12, 0, 0, 0, time.UTC)
+
+	constraints := []Constraint{
+		AllowConstraint("GetInfo"),
+		TimeoutConstraint(60),
+		IPLockConstraint("10.0.0.1"),
+		ClientCertConstraint(fingerprint),
+		MaxChannelCapacityConstraint(1000),
+		ScheduleConstraint(
+			[]time.Weekday{time.Monday}, 9*time.Hour, 17*time.Hour,
+		),
+		NonceConstraint("nonce"),
+		ForbidNodesConstraint(testNodeID(1)),
+		OrConstraint(
+			IPLockConstraint("10.0.0.2"), AccountConstraint("a"),
+		),
+		AllowRegexConstraint("^Get"),
+		UserAgentConstraint("lncli/*"),
+		StreamModeConstraint(Unary),
+		RelativeExpiryConstraint(time.Hour),
+		SkipDuplicates(AccountConstraint("a")),
+	}
+	shared := []checkers.Checker{
+		AllowChecker("GetInfo"),
+		TimeoutChecker(),
+		IPLockChecker("10.0.0.1"),
+		ClientCertChecker(fingerprint),
+		MaxChannelCapacityChecker(1000),
+		ScheduleChecker(monday),
+		NonceChecker(func(string) bool { return false }),
+		ForbidNodesChecker([]string{testNodeID(2)}),
+		OrChecker(IPLockChecker("10.0.0.1"), AccountChecker("a")),
+		AllowRegexChecker("GetInfo"),
+		UserAgentChecker("lncli/0.3"),
+		StreamModeChecker(false),
+		AccountChecker("a"),
+	}
+
+	base := createDummyMacaroon(t)
+	const numGoroutines = 32
+	errs := make(chan error, numGoroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mac, err := AddConstraints(base, constraints...)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			// The relative expiry checker tracks state across
+			// caveats, so every verification needs its own.
+			cs := append([]checkers.Checker{
+				RelativeExpiryChecker(time.Now()),
+			}, shared...)
+			if err := Verify(mac, testRootKey, cs...); err != nil {
+				errs <- err
+				return
+			}
+
+			Inspect(mac)
+			ClassifyCaveats(mac)
+			Describe(mac)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Error using constraints concurrently: %v", err)
+	}
+}
+
+// TestAuthorityConstraint tests that a macaroon is only valid for requests
+// addressed to the authority it's locked to.
+func TestAuthorityConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, authority := range []string{"", "a b", "host:0", "host:x"} {
+		constraint := AuthorityConstraint(authority)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("authority %q should be rejected", authority)
+		}
+	}
+
+	tests := []struct {
+		authority string
+		presented string
+		valid     bool
+	}{
+		{"Payments.Svc", "payments.svc", true},
+		{"payments.svc", "payments.svc:10009", true},
+		{"payments.svc:10009", "PAYMENTS.svc:10009", true},
+		{"payments.svc:10009", "payments.svc:10010", false},
+		{"payments.svc:10009", "payments.svc", false},
+		{"payments.svc", "invoices.svc", false},
+		{"[::1]:10009", "[::1]:10009", true},
+		{"::1", "[::1]:10009", true},
+	}
+	for _, test := range tests {
+		newMac, err := AddConstraints(
+			mac, AuthorityConstraint(test.authority),
+		)
+		if err != nil {
+			t.Fatalf("Error adding constraint for %s: %v",
+				test.authority, err)
+		}
+		err = checkMacaroon(newMac, AuthorityChecker(test.presented))
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected for %s: %v", test.presented,
+				test.authority, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted for %s", test.presented,
+				test.authority)
+		}
+	}
+}
+
+// TestOnionOnlyConstraint tests that an onion-only macaroon is only valid for
+// requests addressed to an onion address.
+func TestOnionOnlyConstraint(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), OnionOnlyConstraint(),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	v3 := strings.Repeat("abcdefg234567", 5)[:56]
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{v3 + ".onion:10009", true},
+		{strings.ToUpper(v3) + ".ONION", true},
+		{"expyuzz4wqqyqhjn.onion:9735", true},
+		{"node.example.com:10009", false},
+		{"203.0.113.7:10009", false},
+		{"[2001:db8::1]:10009", false},
+		{"short.onion:10009", false},
+		{"expyuzz4wqqyqhj1.onion", false},
+		{v3 + ".onion.example.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, OnionChecker(test.addr))
+		if test.valid && err != nil {
+			t.Fatalf("%q rejected: %v", test.addr, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%q accepted", test.addr)
+		}
+	}
+}
+
+// TestNoKeysendConstraint tests that a no-keysend macaroon can pay invoices,
+// but not make keysend payments.
+func TestNoKeysendConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, NoKeysendConstraint())
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	if err := checkMacaroon(newMac, KeysendChecker(false)); err != nil {
+		t.Fatalf("invoice payment rejected: %v", err)
+	}
+	if err := checkMacaroon(newMac, KeysendChecker(true)); err == nil {
+		t.Fatalf("keysend payment accepted")
+	}
+
+	// Without the caveat, keysend is fine.
+	if err := checkMacaroon(mac, KeysendChecker(true)); err != nil {
+		t.Fatalf("unrestricted macaroon rejected: %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package macaroons
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+// macaroonVersion is the serialization format version of the macaroons
+// produced by the macaroon library in use, which only knows the original
+// format.
+const macaroonVersion = 1
+
+// describers maps caveat conditions to the function translating the
+// caveat's argument into a human readable sentence. Composite caveats are
+// handled by describeCondition itself, since their nested conditions are
+// described recursively.
+var describers = map[string]func(arg string) (string, error){
+	checkers.CondAllow: func(arg string) (string, error) {
+		ops := strings.Fields(arg)
+		return "Allows operations: " + strings.Join(ops, ", "), nil
+	},
+	checkers.CondDeny: func(arg string) (string, error) {
+		ops := strings.Fields(arg)
+		return "Denies operations: " + strings.Join(ops, ", "), nil
+	},
+	checkers.CondTimeBefore: func(arg string) (string, error) {
+		expiry, err := time.Parse(time.RFC3339Nano, arg)
+		if err != nil {
+			return "", err
+		}
+		return "Expires at " + expiry.UTC().Format(time.RFC3339), nil
+	},
+	checkers.CondClientIPAddr: func(arg string) (string, error) {
+		return "Locked to IP " + arg, nil
+	},
+	CondClientCert: func(arg string) (string, error) {
+		return "Locked to client certificate " + arg, nil
+	},
+	CondTLSSession: func(arg string) (string, error) {
+		return "Bound to TLS session " + arg, nil
+	},
+	CondMaxChannelCapacity: func(arg string) (string, error) {
+		return "Opens channels of at most " + arg + " sat", nil
+	},
+	CondSchedule: describeSchedule,
+	CondNonce: func(arg string) (string, error) {
+		return "Usable once with nonce " + arg, nil
+	},
+	CondForbidNodes: func(arg string) (string, error) {
+		nodes := strings.Fields(arg)
+		return "Route must avoid nodes: " + strings.Join(nodes, ", "),
+			nil
+	},
+	CondMaxDepth: func(arg string) (string, error) {
+		return "May be delegated at most " + arg + " times", nil
+	},
+	CondDepth: func(arg string) (string, error) {
+		return "Delegated " + arg + " times", nil
+	},
+	CondAccount: func(arg string) (string, error) {
+		return "Restricted to account " + arg, nil
+	},
+	CondFundingAccount: func(arg string) (string, error) {
+		return "Funds transactions only from account " + arg, nil
+	},
+	CondAllowRegex: func(arg string) (string, error) {
+		var patterns []string
+		for _, field := range strings.Fields(arg) {
+			pattern, err := url.QueryUnescape(field)
+			if err != nil {
+				return "", err
+			}
+			patterns = append(patterns, strconv.Quote(pattern))
+		}
+		return "Allows operations matching: " +
+			strings.Join(patterns, ", "), nil
+	},
+	CondUserAgent: func(arg string) (string, error) {
+		var agents []string
+		for _, field := range strings.Fields(arg) {
+			agent, err := url.QueryUnescape(field)
+			if err != nil {
+				return "", err
+			}
+			agents = append(agents, strconv.Quote(agent))
+		}
+		return "Restricted to user agents: " +
+			strings.Join(agents, ", "), nil
+	},
+	CondFiatLimit: func(arg string) (string, error) {
+		fields := strings.Fields(arg)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("invalid fiat limit")
+		}
+		return "Spends at most " + fields[1] + " " + fields[0] +
+			" cents", nil
+	},
+	CondDestination: func(arg string) (string, error) {
+		nodes := strings.Fields(arg)
+		return "Pays only to nodes: " + strings.Join(nodes, ", "), nil
+	},
+	CondOutgoingChannel: func(arg string) (string, error) {
+		return "Pays only through outgoing channel " + arg, nil
+	},
+	CondMinOperators: func(arg string) (string, error) {
+		return "Routes only over nodes of at least " + arg +
+			" distinct operators", nil
+	},
+	CondMinChannelAge: func(arg string) (string, error) {
+		return "Routes only over channels at least " + arg +
+			" blocks old", nil
+	},
+	CondRouteScoreMin: func(arg string) (string, error) {
+		return "Routes only over nodes with an average trust score " +
+			"of at least " + arg, nil
+	},
+	CondPublicOnly: func(string) (string, error) {
+		return "Routes only over public channels", nil
+	},
+	CondClientIPRange: func(arg string) (string, error) {
+		return "Locked to IP range " + arg, nil
+	},
+	CondRequireAllIPs: func(arg string) (string, error) {
+		ips := strings.Fields(arg)
+		return "Locked to requests from all of: " +
+			strings.Join(ips, ", "), nil
+	},
+	CondLabel: func(arg string) (string, error) {
+		return "Labeled " + strconv.Quote(arg), nil
+	},
+	CondDailyUse: func(string) (string, error) {
+		return "Usable once per day (UTC)", nil
+	},
+	CondScope: func(arg string) (string, error) {
+		scopes := strings.Fields(arg)
+		return "Restricted to scopes: " + strings.Join(scopes, ", "),
+			nil
+	},
+	CondAuthority: func(arg string) (string, error) {
+		return "Locked to requests addressed to " + arg, nil
+	},
+	CondNoKeysend: func(string) (string, error) {
+		return "Forbids keysend payments", nil
+	},
+	CondDischargeLocations: func(arg string) (string, error) {
+		locations := strings.Fields(arg)
+		return "Discharged only by: " + strings.Join(locations, ", "),
+			nil
+	},
+	CondDangerAck: func(string) (string, error) {
+		return "Acknowledged for dangerous operations", nil
+	},
+	CondOnionOnly: func(string) (string, error) {
+		return "Valid only for requests over Tor onion addresses", nil
+	},
+	CondCategory: func(arg string) (string, error) {
+		cats := strings.Fields(arg)
+		return "Restricted to method categories: " +
+			strings.Join(cats, ", "), nil
+	},
+	CondSession: func(arg string) (string, error) {
+		return "Valid only within session " + arg, nil
+	},
+	CondIssuedAt: func(arg string) (string, error) {
+		return "Issued at " + arg, nil
+	},
+	CondTTL: func(arg string) (string, error) {
+		seconds, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid ttl %q", arg)
+		}
+		ttl := time.Duration(seconds) * time.Second
+		return "Expires " + ttl.String() + " after issuance", nil
+	},
+	CondVelocity: func(arg string) (string, error) {
+		fields := strings.Fields(arg)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("invalid velocity")
+		}
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid velocity window %q",
+				fields[1])
+		}
+		window := time.Duration(seconds) * time.Second
+		return "Spends at most " + fields[0] + " satoshis per " +
+			window.String(), nil
+	},
+	CondAllowedAddress: func(arg string) (string, error) {
+		addrs := strings.Fields(arg)
+		return "Sends only to: " + strings.Join(addrs, ", "), nil
+	},
+	CondMaxStreams: func(arg string) (string, error) {
+		return "Keeps at most " + arg + " streams open at once", nil
+	},
+	CondMaxPage: func(arg string) (string, error) {
+		return "Lists at most " + arg + " items per page", nil
+	},
+	CondMaxPeers: func(arg string) (string, error) {
+		return "Involves at most " + arg + " peers per call", nil
+	},
+	CondMaxCLTV: func(arg string) (string, error) {
+		return "Locks payment funds for at most " + arg + " blocks", nil
+	},
+	CondMaxFeeRate: func(arg string) (string, error) {
+		return "On-chain fee rate of at most " + arg + " sat/vbyte",
+			nil
+	},
+	CondLiquidityLimit: func(arg string) (string, error) {
+		return "Moves at most " + arg + " satoshis of liquidity", nil
+	},
+	CondStreamMode: func(arg string) (string, error) {
+		return "Restricted to " + arg + " calls", nil
+	},
+	CondMinConfs: func(arg string) (string, error) {
+		return "Funding requires at least " + arg + " confirmations",
+			nil
+	},
+	CondAttestation: func(arg string) (string, error) {
+		fields := strings.Fields(arg)
+		if len(fields) != 2 {
+			return "", fmt.Errorf("invalid attestation")
+		}
+		return "Carries signed attestation " + fields[0], nil
+	},
+}
+
+// describeSchedule translates the argument of a schedule caveat.
+func describeSchedule(arg string) (string, error) {
+	fields := strings.Fields(arg)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("invalid schedule")
+	}
+
+	var days []string
+	for _, dayStr := range strings.Split(fields[0], ",") {
+		day, err := strconv.Atoi(dayStr)
+		if err != nil || day < 0 || day > 6 {
+			return "", fmt.Errorf("invalid weekday %q", dayStr)
+		}
+		days = append(days, time.Weekday(day).String())
+	}
+
+	var times [2]string
+	for i, field := range fields[1:] {
+		seconds, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid time of day %q", field)
+		}
+		midnight := time.Time{}
+		times[i] = midnight.Add(
+			time.Duration(seconds) * time.Second,
+		).Format("15:04")
+	}
+
+	return fmt.Sprintf("Valid on %s between %s and %s UTC",
+		strings.Join(days, ", "), times[0], times[1]), nil
+}
+
+// describeComposite translates the nested conditions of a composite caveat.
+func describeComposite(prefix, arg string) (string, error) {
+	nested, err := splitComposite(arg)
+	if err != nil {
+		return "", err
+	}
+
+	descriptions := make([]string, len(nested))
+	for i, condition := range nested {
+		descriptions[i] = "(" + describeCondition(condition) + ")"
+	}
+	return prefix + ": " + strings.Join(descriptions, ", "), nil
+}
+
+// describeCondition translates a single first-party caveat condition,
+// falling back to the raw condition if it isn't known or can't be parsed.
+func describeCondition(condition string) string {
+	cond, arg, err := parseCaveat(condition)
+	if err != nil {
+		return fmt.Sprintf("Malformed caveat %q", condition)
+	}
+
+	var description string
+	switch cond {
+	case CondOr:
+		description, err = describeComposite("Any of", arg)
+	case CondAnd:
+		description, err = describeComposite("All of", arg)
+	default:
+		describe, ok := describers[cond]
+		if !ok {
+			return fmt.Sprintf("Unrecognized caveat %q", condition)
+		}
+		description, err = describe(arg)
+	}
+	if err != nil {
+		return fmt.Sprintf("Malformed caveat %q: %v", condition, err)
+	}
+	return description
+}
+
+// Describe produces a multi-line human readable report of the authorization
+// scope of the macaroon, translating each of its caveats into a sentence.
+// Caveats that aren't understood are printed raw. If the macaroon carries more
+// than one allow caveat, the operations allowed by all of them together are
+// reported as well, since only their intersection is permitted.
+func Describe(mac *macaroon.Macaroon) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Location: %s\n", mac.Location())
+	fmt.Fprintf(&b, "Version: %d\n", macaroonVersion)
+	fmt.Fprintf(&b, "Identifier: %q\n", mac.Id())
+
+	infos := ListCaveats(mac)
+	if len(infos) == 0 {
+		fmt.Fprintf(&b, "Caveats: none, the macaroon is unrestricted\n")
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "Caveats:\n")
+	allowCaveats := 0
+	for i, info := range infos {
+		if info.Err == nil && info.Identifier == checkers.CondAllow {
+			allowCaveats++
+		}
+
+		var description string
+		switch {
+		case info.Location != "":
+			description = "Must be discharged by " + info.Location
+		case info.Err != nil:
+			description = fmt.Sprintf("Malformed caveat %q",
+				info.Condition)
+		default:
+			description = describeCondition(info.Condition)
+		}
+		fmt.Fprintf(&b, "  %d. %s\n", i+1, description)
+	}
+
+	if allowCaveats > 1 {
+		ops := Inspect(mac).AllowedOps
+		if len(ops) == 0 {
+			fmt.Fprintf(&b, "Effective allow set: none, no "+
+				"operation is allowed\n")
+		} else {
+			fmt.Fprintf(&b, "Effective allow set: %s\n",
+				strings.Join(ops, ", "))
+		}
+	}
+
+	return b.String()
+}
+
+// PermissionDoc is the machine-readable description of a single caveat
+// produced by DocumentConstraints, meant to be serialized and rendered into
+// documentation.
+type PermissionDoc struct {
+	// Condition is the raw caveat condition as stored in the macaroon.
+	Condition string `json:"condition"`
+
+	// Location is the location of the third party that must discharge
+	// the caveat. It's empty for first-party caveats.
+	Location string `json:"location,omitempty"`
+
+	// Kind classifies the caveat like CaveatInfo.Kind does.
+	Kind string `json:"kind"`
+
+	// Argument is the remainder of the condition following its
+	// identifier.
+	Argument string `json:"argument,omitempty"`
+
+	// Description is the same sentence Describe prints for the caveat.
+	Description string `json:"description"`
+
+	// Enforcing is false for caveats that only record something about
+	// the macaroon, such as a label, without restricting its authority.
+	Enforcing bool `json:"enforcing"`
+
+	// External is set if checking the caveat needs external state, or a
+	// discharge from a third party.
+	External bool `json:"external"`
+
+	// Expiry is the time after which the macaroon is no longer valid.
+	// It's only set for time-before caveats.
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// DocumentConstraints is the machine-readable counterpart of Describe,
+// returning a structured description of each caveat of the macaroon, in the
+// order they were added. It fails if any caveat can't be parsed, since there
+// is nothing meaningful to document for it.
+func DocumentConstraints(mac *macaroon.Macaroon) ([]PermissionDoc, error) {
+	infos := ListCaveats(mac)
+	docs := make([]PermissionDoc, 0, len(infos))
+	for i, info := range infos {
+		if info.Err != nil {
+			return nil, fmt.Errorf("caveat %d: malformed caveat "+
+				"%q: %v", i, info.Condition, info.Err)
+		}
+
+		_, informational := informationalConditions[info.Kind]
+		doc := PermissionDoc{
+			Condition: info.Condition,
+			Location:  info.Location,
+			Kind:      info.Kind,
+			Argument:  info.Argument,
+			Enforcing: !informational,
+			Expiry:    info.Expiry,
+		}
+		if info.Location != "" {
+			doc.Description = "Must be discharged by " +
+				info.Location
+			doc.External = true
+		} else {
+			doc.Description = describeCondition(info.Condition)
+			doc.External = isExternal(info.Condition)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
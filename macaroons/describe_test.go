@@ -0,0 +1,320 @@
+package macaroons
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// TestDescribe tests the report produced for a macaroon mixing regular,
+// composite, malformed and unrecognized caveats against a golden file. The
+// description of every known condition is covered by TestDescribeConditions.
+func TestDescribe(t *testing.T) {
+	weekdays := []time.Weekday{
+		time.Monday, time.Tuesday, time.Wednesday, time.Thursday,
+		time.Friday,
+	}
+
+	mac := createDummyMacaroon(t)
+	bare := Describe(mac)
+	if !strings.HasSuffix(bare, "Caveats: none, the macaroon is "+
+		"unrestricted\n") {
+
+		t.Fatalf("unexpected description of bare macaroon: %s", bare)
+	}
+
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo", "SendPayment"),
+		IPLockConstraint("10.0.0.5"),
+		ScheduleConstraint(weekdays, 9*time.Hour, 17*time.Hour),
+		ForbidNodesConstraint(testNodeID(1), testNodeID(2)),
+		OrConstraint(
+			IPLockConstraint("10.0.0.6"),
+			MaxChannelCapacityConstraint(5000000),
+		),
+		DelegationDepthConstraint(2),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	caveats := []string{
+		"time-before 2017-10-06T12:00:00Z",
+		"time-before tomorrow",
+		"future-caveat with args",
+	}
+	for _, caveat := range caveats {
+		if err := newMac.AddFirstPartyCaveat(caveat); err != nil {
+			t.Fatalf("Error adding caveat: %v", err)
+		}
+	}
+
+	golden := filepath.Join("testdata", "describe.golden")
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Error reading golden file: %v", err)
+	}
+	if got := Describe(newMac); got != string(expected) {
+		t.Fatalf("description doesn't match %s, got:\n%s", golden, got)
+	}
+}
+
+// TestDescribeConditions tests the description of a caveat of every known
+// condition, and fails if a known condition is missing from the table, so that
+// new conditions don't go without a describer.
+func TestDescribeConditions(t *testing.T) {
+	node := testNodeID(1)
+	tests := map[string]struct {
+		caveat   string
+		expected string
+	}{
+		checkers.CondAllow: {"allow GetInfo SendPayment",
+			"Allows operations: GetInfo, SendPayment"},
+		checkers.CondDeny: {"deny closechannel",
+			"Denies operations: closechannel"},
+		checkers.CondTimeBefore: {"time-before 2017-10-06T12:00:00Z",
+			"Expires at 2017-10-06T12:00:00Z"},
+		checkers.CondClientIPAddr: {"client-ip-addr 10.0.0.1",
+			"Locked to IP 10.0.0.1"},
+		CondClientCert: {"client-cert abcd",
+			"Locked to client certificate abcd"},
+		CondMaxChannelCapacity: {"max-chan-capacity 500000",
+			"Opens channels of at most 500000 sat"},
+		CondSchedule: {"schedule 1,5 32400 61200",
+			"Valid on Monday, Friday between 09:00 and 17:00 UTC"},
+		CondNonce: {"nonce abc",
+			"Usable once with nonce abc"},
+		CondForbidNodes: {"forbid-nodes " + node,
+			"Route must avoid nodes: " + node},
+		CondPublicOnly: {"public-only",
+			"Routes only over public channels"},
+		CondRouteScoreMin: {"route-score-min 0.8",
+			"Routes only over nodes with an average trust score " +
+				"of at least 0.8"},
+		CondMaxDepth: {"max-depth 2",
+			"May be delegated at most 2 times"},
+		CondDepth: {"depth 1",
+			"Delegated 1 times"},
+		CondAccount: {"account savings",
+			"Restricted to account savings"},
+		CondAttestation: {"attestation cA== c2ln",
+			"Carries signed attestation cA=="},
+		CondMinConfs: {"min-confs 3",
+			"Funding requires at least 3 confirmations"},
+		CondAllowRegex: {"allow-regex %5EGet.%2A%24",
+			`Allows operations matching: "^Get.*$"`},
+		CondUserAgent: {"user-agent lncli%2F0.4 zap%2A",
+			`Restricted to user agents: "lncli/0.4", "zap*"`},
+		CondFiatLimit: {"fiat-limit USD 500",
+			"Spends at most 500 USD cents"},
+		CondStreamMode: {"stream-mode unary",
+			"Restricted to unary calls"},
+		CondLiquidityLimit: {"liquidity-limit 100000",
+			"Moves at most 100000 satoshis of liquidity"},
+		CondAllowedAddress: {"allowed-addr addr1 addr2",
+			"Sends only to: addr1, addr2"},
+		CondVelocity: {"velocity 1000 3600",
+			"Spends at most 1000 satoshis per 1h0m0s"},
+		CondRequireAllIPs: {"client-ip-all 10.0.0.1 10.0.0.2",
+			"Locked to requests from all of: 10.0.0.1, 10.0.0.2"},
+		CondIssuedAt: {"issued-at 2017-10-06T12:00:00Z",
+			"Issued at 2017-10-06T12:00:00Z"},
+		CondTTL: {"ttl 3600",
+			"Expires 1h0m0s after issuance"},
+		CondSession: {"session s1",
+			"Valid only within session s1"},
+		CondLabel: {"label ci",
+			`Labeled "ci"`},
+		CondMaxFeeRate: {"max-fee-rate 50",
+			"On-chain fee rate of at most 50 sat/vbyte"},
+		CondDailyUse: {"daily-use",
+			"Usable once per day (UTC)"},
+		CondClientIPRange: {"client-ip-range 10.0.0.0/8",
+			"Locked to IP range 10.0.0.0/8"},
+		CondScope: {"scope invoices:read",
+			"Restricted to scopes: invoices:read"},
+		CondAuthority: {"authority node.example.com:10009",
+			"Locked to requests addressed to " +
+				"node.example.com:10009"},
+		CondDestination: {"destination " + node,
+			"Pays only to nodes: " + node},
+		CondTLSSession: {"tls-session c2Vzc2lvbg==",
+			"Bound to TLS session c2Vzc2lvbg=="},
+		CondMaxCLTV: {"max-cltv 144",
+			"Locks payment funds for at most 144 blocks"},
+		CondFundingAccount: {"funding-account cold",
+			"Funds transactions only from account cold"},
+		CondOutgoingChannel: {"out-chan 1234",
+			"Pays only through outgoing channel 1234"},
+		CondOnionOnly: {"onion-only",
+			"Valid only for requests over Tor onion addresses"},
+		CondDangerAck: {"danger-ack",
+			"Acknowledged for dangerous operations"},
+		CondNoKeysend: {"no-keysend",
+			"Forbids keysend payments"},
+		CondMinOperators: {"min-operators 3",
+			"Routes only over nodes of at least 3 distinct " +
+				"operators"},
+		CondMaxStreams: {"max-streams 5",
+			"Keeps at most 5 streams open at once"},
+		CondDischargeLocations: {"discharge-locations https://auth",
+			"Discharged only by: https://auth"},
+		CondCategory: {"category wallet info",
+			"Restricted to method categories: wallet, info"},
+		CondMaxPage: {"max-page 100",
+			"Lists at most 100 items per page"},
+		CondMaxPeers: {"max-peers 3",
+			"Involves at most 3 peers per call"},
+		CondMinChannelAge: {"min-chan-age 144",
+			"Routes only over channels at least 144 blocks old"},
+		CondOr: {"or client-ip-addr+10.0.0.1 min-confs+3",
+			"Any of: (Locked to IP 10.0.0.1), (Funding requires " +
+				"at least 3 confirmations)"},
+		CondAnd: {"and account+savings max-fee-rate+50",
+			"All of: (Restricted to account savings), (On-chain " +
+				"fee rate of at most 50 sat/vbyte)"},
+	}
+
+	for cond := range knownConditions {
+		test, ok := tests[cond]
+		if !ok {
+			t.Fatalf("no description test for condition %q", cond)
+		}
+		if got := describeCondition(test.caveat); got != test.expected {
+			t.Fatalf("expected description %q for %q, got %q",
+				test.expected, test.caveat, got)
+		}
+	}
+}
+
+// TestDescribeEffectiveAllowSet tests that the intersection of several allow
+// caveats is reported as a single list, and only when there are several.
+func TestDescribeEffectiveAllowSet(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	tests := []struct {
+		allows   [][]string
+		expected string
+	}{
+		{[][]string{{"GetInfo", "SendPayment"}}, ""},
+		{[][]string{
+			{"SendPayment", "GetInfo", "ListChannels"},
+			{"ListChannels", "OpenChannel", "GetInfo"},
+		}, "Effective allow set: GetInfo, ListChannels\n"},
+		{[][]string{
+			{"GetInfo", "ListChannels"}, {"GetInfo", "SendPayment"},
+			{"GetInfo", "OpenChannel"},
+		}, "Effective allow set: GetInfo\n"},
+		{[][]string{{"GetInfo"}, {"SendPayment"}},
+			"Effective allow set: none, no operation is allowed\n"},
+	}
+	for _, test := range tests {
+		cs := make([]Constraint, len(test.allows))
+		for i, ops := range test.allows {
+			cs[i] = AllowConstraint(ops...)
+		}
+		newMac, err := AddConstraints(mac, cs...)
+		if err != nil {
+			t.Fatalf("Error adding constraints: %v", err)
+		}
+
+		description := Describe(newMac)
+		idx := strings.Index(description, "Effective allow set")
+		got := ""
+		if idx >= 0 {
+			got = description[idx:]
+		}
+		if got != test.expected {
+			t.Fatalf("allow caveats %v: expected %q, got %q",
+				test.allows, test.expected, got)
+		}
+	}
+}
+
+// TestDocumentConstraints tests the structured description of a macaroon
+// carrying several kinds of caveats.
+func TestDocumentConstraints(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), LabelConstraint("ci"),
+		NonceConstraint("abc"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	caveats := []string{
+		"time-before 2017-10-06T12:00:00Z", "future-caveat with args",
+	}
+	for _, caveat := range caveats {
+		if err := newMac.AddFirstPartyCaveat(caveat); err != nil {
+			t.Fatalf("Error adding caveat: %v", err)
+		}
+	}
+	err = newMac.AddThirdPartyCaveat([]byte("key"), "id", "https://auth")
+	if err != nil {
+		t.Fatalf("Error adding third-party caveat: %v", err)
+	}
+
+	expiry := time.Date(2017, 10, 6, 12, 0, 0, 0, time.UTC)
+	expected := []PermissionDoc{{
+		Condition:   "allow GetInfo",
+		Kind:        "allow",
+		Argument:    "GetInfo",
+		Description: "Allows operations: GetInfo",
+		Enforcing:   true,
+	}, {
+		Condition:   "label ci",
+		Kind:        CondLabel,
+		Argument:    "ci",
+		Description: `Labeled "ci"`,
+	}, {
+		Condition:   "nonce abc",
+		Kind:        CondNonce,
+		Argument:    "abc",
+		Description: "Usable once with nonce abc",
+		Enforcing:   true,
+		External:    true,
+	}, {
+		Condition:   "time-before 2017-10-06T12:00:00Z",
+		Kind:        "time-before",
+		Argument:    "2017-10-06T12:00:00Z",
+		Description: "Expires at 2017-10-06T12:00:00Z",
+		Enforcing:   true,
+		Expiry:      &expiry,
+	}, {
+		Condition:   "future-caveat with args",
+		Kind:        KindUnknown,
+		Argument:    "with args",
+		Description: `Unrecognized caveat "future-caveat with args"`,
+		Enforcing:   true,
+	}, {
+		Condition:   "id",
+		Location:    "https://auth",
+		Kind:        KindThirdParty,
+		Description: "Must be discharged by https://auth",
+		Enforcing:   true,
+		External:    true,
+	}}
+
+	docs, err := DocumentConstraints(newMac)
+	if err != nil {
+		t.Fatalf("Error documenting constraints: %v", err)
+	}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Fatalf("expected docs %+v, got %+v", expected, docs)
+	}
+	if _, err := json.Marshal(docs); err != nil {
+		t.Fatalf("Error serializing docs: %v", err)
+	}
+
+	if err := newMac.AddFirstPartyCaveat(" "); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if _, err := DocumentConstraints(newMac); err == nil {
+		t.Fatalf("expected malformed caveat to fail")
+	}
+}
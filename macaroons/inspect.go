@@ -0,0 +1,436 @@
+package macaroons
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+const (
+	// KindUnknown is the kind of first-party caveats whose condition
+	// isn't known to this package, or which couldn't be parsed.
+	KindUnknown = "unknown"
+
+	// KindThirdParty is the kind of caveats that must be discharged by a
+	// third party.
+	KindThirdParty = "third-party"
+)
+
+// knownConditions is the set of caveat conditions understood by this
+// package. The kind of a caveat with one of these conditions is the
+// condition itself.
+var knownConditions = map[string]struct{}{
+	checkers.CondAllow:        {},
+	checkers.CondDeny:         {},
+	checkers.CondTimeBefore:   {},
+	checkers.CondClientIPAddr: {},
+	CondClientCert:            {},
+	CondMaxChannelCapacity:    {},
+	CondSchedule:              {},
+	CondNonce:                 {},
+	CondForbidNodes:           {},
+	CondPublicOnly:            {},
+	CondRouteScoreMin:         {},
+	CondMaxDepth:              {},
+	CondDepth:                 {},
+	CondAccount:               {},
+	CondAttestation:           {},
+	CondMinConfs:              {},
+	CondAllowRegex:            {},
+	CondUserAgent:             {},
+	CondFiatLimit:             {},
+	CondStreamMode:            {},
+	CondLiquidityLimit:        {},
+	CondAllowedAddress:        {},
+	CondVelocity:              {},
+	CondRequireAllIPs:         {},
+	CondIssuedAt:              {},
+	CondTTL:                   {},
+	CondSession:               {},
+	CondLabel:                 {},
+	CondMaxFeeRate:            {},
+	CondDailyUse:              {},
+	CondClientIPRange:         {},
+	CondScope:                 {},
+	CondAuthority:             {},
+	CondDestination:           {},
+	CondTLSSession:            {},
+	CondMaxCLTV:               {},
+	CondFundingAccount:        {},
+	CondOutgoingChannel:       {},
+	CondOnionOnly:             {},
+	CondDangerAck:             {},
+	CondNoKeysend:             {},
+	CondMinOperators:          {},
+	CondMaxStreams:            {},
+	CondDischargeLocations:    {},
+	CondCategory:              {},
+	CondMaxPage:               {},
+	CondMaxPeers:              {},
+	CondMinChannelAge:         {},
+	CondOr:                    {},
+	CondAnd:                   {},
+}
+
+// limitConditions maps the conditions of caveats carrying a numeric limit to
+// whether the limit is a cap, as opposed to a floor. When a macaroon carries
+// several caveats with the same condition, the lowest cap or the highest floor
+// is the one in effect.
+var limitConditions = map[string]bool{
+	CondMaxChannelCapacity: true,
+	CondMinConfs:           false,
+	CondMinOperators:       false,
+	CondMinChannelAge:      false,
+	CondLiquidityLimit:     true,
+	CondMaxFeeRate:         true,
+	CondMaxCLTV:            true,
+	CondMaxStreams:         true,
+	CondMaxPage:            true,
+	CondMaxPeers:           true,
+}
+
+// CaveatInfo is a parsed view of a single caveat of a macaroon.
+type CaveatInfo struct {
+	// Condition is the raw caveat condition as stored in the macaroon.
+	Condition string
+
+	// Location is the location of the third party that must discharge
+	// the caveat. It's empty for first-party caveats.
+	Location string
+
+	// Identifier is the condition identifier, e.g. "time-before".
+	Identifier string
+
+	// Argument is the remainder of the condition following the
+	// identifier.
+	Argument string
+
+	// Kind classifies the caveat. It's the condition identifier for
+	// conditions known to this package, and either KindUnknown or
+	// KindThirdParty otherwise.
+	Kind string
+
+	// Expiry is the time after which the macaroon is no longer valid.
+	// It's only set for time-before caveats.
+	Expiry *time.Time
+
+	// Remaining is the time left until Expiry at the moment the caveats
+	// were listed. It's negative for an expired macaroon.
+	Remaining time.Duration
+
+	// Err is set if the caveat couldn't be parsed. Only Condition and
+	// Location are reliable in that case.
+	Err error
+}
+
+// ListCaveats returns a parsed description of every caveat of the macaroon,
+// in the order they were added. A caveat that fails to parse doesn't abort the
+// listing; instead, its Err field is set.
+func ListCaveats(mac *macaroon.Macaroon) []CaveatInfo {
+	caveats := mac.Caveats()
+	infos := make([]CaveatInfo, 0, len(caveats))
+	for _, caveat := range caveats {
+		info := CaveatInfo{
+			Condition: caveat.Id,
+			Location:  caveat.Location,
+			Kind:      KindUnknown,
+		}
+
+		// Third-party caveat ids are opaque to us, so there's nothing
+		// left to parse.
+		if caveat.Location != "" {
+			info.Kind = KindThirdParty
+			infos = append(infos, info)
+			continue
+		}
+
+		cond, arg, err := parseCaveat(caveat.Id)
+		if err != nil {
+			info.Err = err
+			infos = append(infos, info)
+			continue
+		}
+		info.Identifier, info.Argument = cond, arg
+		if _, ok := knownConditions[cond]; ok {
+			info.Kind = cond
+		}
+
+		if cond == checkers.CondTimeBefore {
+			expiry, err := time.Parse(time.RFC3339Nano, arg)
+			if err != nil {
+				info.Err = fmt.Errorf("invalid expiry time "+
+					"%q: %v", arg, err)
+			} else {
+				info.Expiry = &expiry
+				info.Remaining = expiry.Sub(now())
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// CaveatStats returns the number of caveats of each kind carried by the
+// macaroon, which is useful to instrument a fleet of credentials. Kinds not
+// present in the macaroon are omitted.
+func CaveatStats(mac *macaroon.Macaroon) map[string]int {
+	stats := make(map[string]int)
+	for _, info := range ListCaveats(mac) {
+		stats[info.Kind]++
+	}
+	return stats
+}
+
+// externalConditions is the set of caveat conditions that can't be checked
+// with the request alone, but need state kept outside of the macaroon, such
+// as seen nonces or spending totals.
+var externalConditions = map[string]struct{}{
+	CondNonce:          {},
+	CondFiatLimit:      {},
+	CondLiquidityLimit: {},
+	CondVelocity:       {},
+	CondSession:        {},
+	CondDailyUse:       {},
+	CondMaxStreams:     {},
+}
+
+// informationalConditions is the set of caveat conditions that only record
+// something about a macaroon, and don't restrict its authority on their own.
+var informationalConditions = map[string]struct{}{
+	CondLabel:    {},
+	CondIssuedAt: {},
+	CondDepth:    {},
+}
+
+// grantingConditions is the set of caveat conditions that don't restrict a
+// macaroon at all, but rather opt it into something, like dangerous
+// operations. Unlike informational caveats they mustn't be stripped.
+var grantingConditions = map[string]struct{}{
+	CondDangerAck: {},
+}
+
+// isExternal returns whether checking the first-party caveat condition needs
+// external state. A composite caveat does if any of its nested conditions
+// does.
+func isExternal(condition string) bool {
+	cond, arg, err := parseCaveat(condition)
+	if err != nil {
+		return false
+	}
+	if cond == CondOr || cond == CondAnd {
+		nested, err := splitComposite(arg)
+		if err != nil {
+			return false
+		}
+		for _, n := range nested {
+			if isExternal(n) {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := externalConditions[cond]
+	return ok
+}
+
+// ClassifyCaveats splits the caveat conditions of the macaroon into those that
+// can be checked with only the request at hand, like expiry or client IP, and
+// those that need a lookup of external state, like nonces or spending totals.
+// Third-party caveats are external, as they need a discharge. Unknown and
+// malformed caveats are local: they fail without any lookup.
+func ClassifyCaveats(mac *macaroon.Macaroon) (local, external []string) {
+	for _, caveat := range mac.Caveats() {
+		if caveat.Location != "" || isExternal(caveat.Id) {
+			external = append(external, caveat.Id)
+		} else {
+			local = append(local, caveat.Id)
+		}
+	}
+	return local, external
+}
+
+// Inspection is the authorization scope of a macaroon, derived from its
+// caveats.
+type Inspection struct {
+	// Caveats is the parsed view of every caveat of the macaroon.
+	Caveats []CaveatInfo
+
+	// AllowedOps is the set of operations permitted by all allow caveats
+	// together, sorted. It's nil if the macaroon has no allow caveat,
+	// which leaves operations unrestricted.
+	AllowedOps []string
+
+	// Expiry is the earliest expiry among the time-before caveats and the
+	// issued-at and ttl pairs, or nil if the macaroon never expires.
+	Expiry *time.Time
+
+	// Limits maps the condition of every numeric limit carried by the
+	// macaroon to the value in effect.
+	Limits map[string]int64
+}
+
+// Inspect derives the authorization scope of the macaroon from its caveats.
+// It doesn't verify the macaroon in any way, see VerifyAndInspect for that.
+func Inspect(mac *macaroon.Macaroon) Inspection {
+	inspection := Inspection{
+		Caveats: ListCaveats(mac),
+		Limits:  make(map[string]int64),
+	}
+
+	var allowed map[string]struct{}
+	for _, info := range inspection.Caveats {
+		if info.Err != nil {
+			continue
+		}
+
+		switch info.Identifier {
+		case checkers.CondAllow:
+			ops := make(map[string]struct{})
+			for _, op := range strings.Fields(info.Argument) {
+				_, ok := allowed[op]
+				if allowed == nil || ok {
+					ops[op] = struct{}{}
+				}
+			}
+			allowed = ops
+
+		case checkers.CondTimeBefore:
+			if inspection.Expiry == nil ||
+				info.Expiry.Before(*inspection.Expiry) {
+
+				inspection.Expiry = info.Expiry
+			}
+		}
+
+		isCap, ok := limitConditions[info.Identifier]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseInt(info.Argument, 10, 64)
+		if err != nil {
+			continue
+		}
+		current, ok := inspection.Limits[info.Identifier]
+		if !ok || (isCap && value < current) ||
+			(!isCap && value > current) {
+
+			inspection.Limits[info.Identifier] = value
+		}
+	}
+
+	// Unpaired issued-at and ttl caveats fail verification, so only the
+	// complete pairs are of interest here.
+	relExpiry, _ := relativeExpiry(inspection.Caveats)
+	if relExpiry != nil && (inspection.Expiry == nil ||
+		relExpiry.Before(*inspection.Expiry)) {
+
+		inspection.Expiry = relExpiry
+	}
+
+	if allowed != nil {
+		ops := make([]string, 0, len(allowed))
+		for op := range allowed {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		inspection.AllowedOps = ops
+	}
+
+	return inspection
+}
+
+// IsReadOnly returns whether the allow caveats of the macaroon restrict it to
+// operations the given predicate considers non-mutating, which gives a quick
+// idea of the damage a leaked macaroon could do. A macaroon without any allow
+// caveat isn't read-only, as nothing restricts its operations.
+func IsReadOnly(mac *macaroon.Macaroon,
+	isMutating func(op string) bool) (bool, error) {
+
+	if isMutating == nil {
+		return false, fmt.Errorf("mutating operation predicate is " +
+			"required")
+	}
+
+	ops := Inspect(mac).AllowedOps
+	if ops == nil {
+		return false, nil
+	}
+	for _, op := range ops {
+		if isMutating(op) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RequireConstrained returns an error if the macaroon has no first-party
+// caveat restricting it, which makes it as powerful as its root key allows.
+// Issuers can use it to assert that they're not handing out an unrestricted
+// macaroon by mistake. Informational caveats like labels don't count, since
+// they don't restrict anything, and neither do danger-ack caveats or
+// third-party caveats. Unknown or malformed caveats don't count either, since
+// there's no telling what, if anything, they restrict.
+func RequireConstrained(mac *macaroon.Macaroon) error {
+	for _, info := range EnforcingCaveats(mac) {
+		if info.Location == "" && info.Err == nil &&
+			info.Kind != KindUnknown {
+
+			return nil
+		}
+	}
+	return fmt.Errorf("macaroon %q has no first-party caveat "+
+		"restricting it", mac.Id())
+}
+
+// LockedIPs returns every IP address and range, in CIDR notation, that the
+// macaroon is locked to by its client-ip-addr and client-ip-range caveats, in
+// the order of the caveats. Since all caveats must be satisfied, a client must
+// match every one of them.
+func LockedIPs(mac *macaroon.Macaroon) []string {
+	var ips []string
+	for _, info := range ListCaveats(mac) {
+		if info.Err != nil {
+			continue
+		}
+		switch info.Identifier {
+		case checkers.CondClientIPAddr, CondClientIPRange:
+			ips = append(ips, info.Argument)
+		}
+	}
+	return ips
+}
+
+// LockedIP returns the first IP address or range the macaroon is locked to,
+// and whether it's locked to any at all. See LockedIPs for macaroons carrying
+// several IP caveats.
+func LockedIP(mac *macaroon.Macaroon) (string, bool) {
+	ips := LockedIPs(mac)
+	if len(ips) == 0 {
+		return "", false
+	}
+	return ips[0], true
+}
+
+// EnforcingCaveats returns the caveats of the macaroon that actually gate
+// authorization, in order, leaving out informational ones such as labels or
+// issued-at times, and danger-ack caveats, which only widen what a macaroon
+// may be used for. Third-party caveats, as well as unknown or malformed ones,
+// are all considered enforcing, as they can make verification fail.
+func EnforcingCaveats(mac *macaroon.Macaroon) []CaveatInfo {
+	var enforcing []CaveatInfo
+	for _, info := range ListCaveats(mac) {
+		_, informational := informationalConditions[info.Kind]
+		_, granting := grantingConditions[info.Kind]
+		if !informational && !granting {
+			enforcing = append(enforcing, info)
+		}
+	}
+	return enforcing
+}
@@ -0,0 +1,280 @@
+package macaroons
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListCaveats tests that time-before caveats are resolved to a typed
+// expiry and that a malformed caveat is flagged without breaking the listing.
+func TestListCaveats(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	err = newMac.AddFirstPartyCaveat("time-before garbage")
+	if err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	infos := ListCaveats(newMac)
+	if len(infos) != 3 {
+		t.Fatalf("expected 3 caveats, got %d", len(infos))
+	}
+
+	if infos[0].Identifier != "allow" || infos[0].Argument != "GetInfo" {
+		t.Fatalf("unexpected allow caveat: %+v", infos[0])
+	}
+	if infos[0].Expiry != nil {
+		t.Fatalf("allow caveat shouldn't carry an expiry")
+	}
+
+	if infos[1].Err != nil || infos[1].Expiry == nil {
+		t.Fatalf("expected parsed expiry, got %+v", infos[1])
+	}
+	if infos[1].Remaining <= 0 || infos[1].Remaining > time.Minute {
+		t.Fatalf("unexpected remaining duration %v", infos[1].Remaining)
+	}
+
+	if infos[2].Err == nil || infos[2].Expiry != nil {
+		t.Fatalf("malformed caveat not flagged: %+v", infos[2])
+	}
+}
+
+// TestCaveatStats tests that caveats are counted per kind, with unrecognized
+// ones grouped together.
+func TestCaveatStats(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo", "SendPayment"),
+		AllowConstraint("GetInfo"), TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	if err := newMac.AddFirstPartyCaveat("future-caveat"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	expected := map[string]int{
+		"allow":       2,
+		"time-before": 1,
+		KindUnknown:   1,
+	}
+	if stats := CaveatStats(newMac); !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %v, got %v", expected, stats)
+	}
+}
+
+// TestClassifyCaveats tests that caveats needing external state, including
+// nested ones and third-party caveats, are told apart from local ones.
+func TestClassifyCaveats(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), IPLockConstraint("10.0.0.1"),
+		NonceConstraint("n1"), LiquidityLimitConstraint(1000),
+		OrConstraint(AccountConstraint("a"), NonceConstraint("n2")),
+		OrConstraint(AccountConstraint("a"), AccountConstraint("b")),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	err = newMac.AddThirdPartyCaveat([]byte("key"), "revoked?", "revoker")
+	if err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	local, external := ClassifyCaveats(newMac)
+	expectedLocal := []string{
+		"allow GetInfo", "client-ip-addr 10.0.0.1",
+		"or account+a account+b",
+	}
+	expectedExternal := []string{
+		"nonce n1", "liquidity-limit 1000", "or account+a nonce+n2",
+		"revoked?",
+	}
+	if !reflect.DeepEqual(local, expectedLocal) {
+		t.Fatalf("expected local caveats %q, got %q", expectedLocal,
+			local)
+	}
+	if !reflect.DeepEqual(external, expectedExternal) {
+		t.Fatalf("expected external caveats %q, got %q",
+			expectedExternal, external)
+	}
+}
+
+// TestIsReadOnly tests that a macaroon is only read-only if its allow caveats
+// leave no mutating operation allowed.
+func TestIsReadOnly(t *testing.T) {
+	isMutating := func(op string) bool {
+		return !strings.HasPrefix(op, "Get") &&
+			!strings.HasPrefix(op, "List")
+	}
+
+	tests := []struct {
+		name        string
+		constraints []Constraint
+		readOnly    bool
+	}{
+		{"unrestricted", nil, false},
+		{
+			"read only",
+			[]Constraint{AllowConstraint("GetInfo", "ListPeers")},
+			true,
+		},
+		{
+			"mutating",
+			[]Constraint{AllowConstraint("GetInfo", "SendPayment")},
+			false,
+		},
+		{
+			"narrowed to read only",
+			[]Constraint{
+				AllowConstraint("GetInfo", "SendPayment"),
+				AllowConstraint("GetInfo", "ListPeers"),
+			},
+			true,
+		},
+		{
+			"nothing allowed",
+			[]Constraint{
+				AllowConstraint("SendPayment"),
+				AllowConstraint("GetInfo"),
+			},
+			true,
+		},
+	}
+	for _, test := range tests {
+		mac, err := AddConstraints(
+			createDummyMacaroon(t), test.constraints...,
+		)
+		if err != nil {
+			t.Fatalf("%s: Error adding constraints: %v", test.name,
+				err)
+		}
+		readOnly, err := IsReadOnly(mac, isMutating)
+		if err != nil {
+			t.Fatalf("%s: Error checking macaroon: %v", test.name,
+				err)
+		}
+		if readOnly != test.readOnly {
+			t.Fatalf("%s: expected read only %v, got %v",
+				test.name, test.readOnly, readOnly)
+		}
+	}
+
+	if _, err := IsReadOnly(createDummyMacaroon(t), nil); err == nil {
+		t.Fatalf("missing predicate accepted")
+	}
+}
+
+// TestRequireConstrained tests that only macaroons restricted by a first-party
+// caveat pass.
+func TestRequireConstrained(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if err := RequireConstrained(mac); err == nil {
+		t.Fatalf("macaroon without caveats accepted")
+	}
+
+	labeled, err := AddConstraints(mac, LabelConstraint("ci"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if err := RequireConstrained(labeled); err == nil {
+		t.Fatalf("macaroon with only a label accepted")
+	}
+
+	acked, err := AddConstraints(mac, DangerAckConstraint())
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if err := RequireConstrained(acked); err == nil {
+		t.Fatalf("macaroon with only a danger-ack accepted")
+	}
+
+	unknown := mac.Clone()
+	if err := unknown.AddFirstPartyCaveat("future-caveat x"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if err := RequireConstrained(unknown); err == nil {
+		t.Fatalf("macaroon with only an unknown caveat accepted")
+	}
+
+	constrained, err := AddConstraints(labeled, AllowConstraint("GetInfo"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if err := RequireConstrained(constrained); err != nil {
+		t.Fatalf("constrained macaroon rejected: %v", err)
+	}
+}
+
+// TestLockedIPs tests that the IP addresses and ranges a macaroon is locked to
+// are extracted in order.
+func TestLockedIPs(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	if ip, ok := LockedIP(mac); ok {
+		t.Fatalf("unlocked macaroon reported locked to %s", ip)
+	}
+
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"),
+		IPRangeConstraint("10.0.0.0/8"), IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	ip, ok := LockedIP(newMac)
+	if !ok || ip != "10.0.0.0/8" {
+		t.Fatalf("expected lock to 10.0.0.0/8, got %q", ip)
+	}
+	expected := []string{"10.0.0.0/8", "10.0.0.1"}
+	if ips := LockedIPs(newMac); !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("expected locks %v, got %v", expected, ips)
+	}
+}
+
+// TestEnforcingCaveats tests that informational caveats are left out, while
+// caveats restricting the macaroon are all kept in order.
+func TestEnforcingCaveats(t *testing.T) {
+	mac, err := Delegate(
+		createDummyMacaroon(t), LabelConstraint("my app"),
+		AllowConstraint("GetInfo"), TimeoutConstraint(60),
+		IPLockConstraint("10.0.0.1"),
+		RelativeExpiryConstraint(time.Hour), DangerAckConstraint(),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	if err := mac.AddFirstPartyCaveat("future-caveat"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	var kinds []string
+	for _, info := range EnforcingCaveats(mac) {
+		kinds = append(kinds, info.Kind)
+	}
+	expected := []string{
+		"allow", "time-before", "client-ip-addr", CondTTL, KindUnknown,
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected enforcing caveats %v, got %v", expected,
+			kinds)
+	}
+
+	// A label doesn't get in the way of verification.
+	labeled, err := AddConstraints(
+		createDummyMacaroon(t), LabelConstraint("my app"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if err := checkMacaroon(labeled, LabelChecker()); err != nil {
+		t.Fatalf("Error verifying labeled macaroon: %v", err)
+	}
+}
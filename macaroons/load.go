@@ -0,0 +1,59 @@
+package macaroons
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+var (
+	// ErrReadMacaroon is wrapped by the error LoadAndConstrain returns if
+	// the macaroon file can't be read.
+	ErrReadMacaroon = errors.New("unable to read macaroon file")
+
+	// ErrDecodeMacaroon is wrapped by the error LoadAndConstrain returns
+	// if the contents of the macaroon file can't be decoded.
+	ErrDecodeMacaroon = errors.New("unable to decode macaroon file")
+
+	// ErrConstrainMacaroon is wrapped by the error LoadAndConstrain
+	// returns if one of the constraints fails.
+	ErrConstrainMacaroon = errors.New("unable to constrain macaroon")
+)
+
+// LoadAndConstrain reads the macaroon stored in the file at path, such as the
+// admin macaroon, and derives a new macaroon from it with the passed
+// constraints added, like AddConstraints does. The file may hold either the
+// binary serialization of the macaroon or the armored form produced by
+// EncodeArmored. The returned error wraps ErrReadMacaroon, ErrDecodeMacaroon or
+// ErrConstrainMacaroon depending on the step that failed, along with the
+// underlying error.
+func LoadAndConstrain(path string,
+	cs ...Constraint) (*macaroon.Macaroon, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrReadMacaroon, err)
+	}
+
+	var mac *macaroon.Macaroon
+	armorHeader := []byte("-----BEGIN " + armorType + "-----")
+	if bytes.HasPrefix(bytes.TrimSpace(data), armorHeader) {
+		mac, err = DecodeArmored(data)
+	} else {
+		mac = &macaroon.Macaroon{}
+		err = mac.UnmarshalBinary(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", ErrDecodeMacaroon, path,
+			err)
+	}
+
+	newMac, err := AddConstraints(mac, cs...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrConstrainMacaroon, err)
+	}
+	return newMac, nil
+}
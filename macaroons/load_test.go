@@ -0,0 +1,74 @@
+package macaroons
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadAndConstrain tests that a macaroon is loaded from a file in either
+// format and constrained, and that each kind of failure is reported with the
+// matching error.
+func TestLoadAndConstrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macaroons")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mac := createDummyMacaroon(t)
+	macBytes, err := mac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing macaroon: %v", err)
+	}
+	armored, err := EncodeArmored(mac)
+	if err != nil {
+		t.Fatalf("Error armoring macaroon: %v", err)
+	}
+	files := map[string][]byte{
+		"admin.macaroon":   macBytes,
+		"admin.armored":    armored,
+		"garbage.macaroon": []byte("not a macaroon"),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"admin.macaroon", "admin.armored"} {
+		newMac, err := LoadAndConstrain(
+			filepath.Join(dir, name), AllowConstraint("GetInfo"),
+		)
+		if err != nil {
+			t.Fatalf("Error loading %s: %v", name, err)
+		}
+		err = checkMacaroon(newMac, AllowChecker("GetInfo"))
+		if err != nil {
+			t.Fatalf("Error verifying %s: %v", name, err)
+		}
+		err = checkMacaroon(newMac, AllowChecker("Shutdown"))
+		if err == nil {
+			t.Fatalf("constraint of %s not applied", name)
+		}
+	}
+
+	_, err = LoadAndConstrain(filepath.Join(dir, "missing.macaroon"))
+	if !errors.Is(err, ErrReadMacaroon) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrReadMacaroon, got %v", err)
+	}
+	_, err = LoadAndConstrain(filepath.Join(dir, "garbage.macaroon"))
+	if !errors.Is(err, ErrDecodeMacaroon) {
+		t.Fatalf("expected ErrDecodeMacaroon, got %v", err)
+	}
+	_, err = LoadAndConstrain(
+		filepath.Join(dir, "admin.macaroon"),
+		IPLockConstraint("nowhere"),
+	)
+	if !errors.Is(err, ErrConstrainMacaroon) {
+		t.Fatalf("expected ErrConstrainMacaroon, got %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+package macaroons
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+const (
+	// CondForbidNodes is the caveat condition which forbids a set of
+	// nodes from appearing anywhere in the route of a payment.
+	CondForbidNodes = "forbid-nodes"
+
+	// CondPublicOnly is the caveat condition which restricts payments to
+	// routes made up of public channels only.
+	CondPublicOnly = "public-only"
+
+	// CondRouteScoreMin is the caveat condition which sets the minimum
+	// average trust score of the nodes of a payment route.
+	CondRouteScoreMin = "route-score-min"
+
+	// CondDestination is the caveat condition which restricts payments to
+	// a set of final recipients.
+	CondDestination = "destination"
+
+	// CondOutgoingChannel is the caveat condition which restricts payments
+	// to leaving through a given channel.
+	CondOutgoingChannel = "out-chan"
+
+	// CondMinOperators is the caveat condition which sets the minimum
+	// number of distinct operators running the nodes of a payment route.
+	CondMinOperators = "min-operators"
+
+	// CondMinChannelAge is the caveat condition which sets the minimum
+	// age, in blocks, of every channel of a payment route.
+	CondMinChannelAge = "min-chan-age"
+
+	// nodeIDLen is the length of a serialized compressed public key
+	// identifying a node.
+	nodeIDLen = 33
+
+	// forbidNodesChunk is the maximum number of nodes listed in a single
+	// caveat by ForbidNodesFromConstraint. It keeps each caveat at a few
+	// kilobytes, well below the packet size limit of the macaroon format.
+	forbidNodesChunk = 100
+)
+
+// parseNodeID checks that the passed string is a hex-encoded compressed
+// public key and returns its canonical lowercase form.
+func parseNodeID(nodeID string) (string, error) {
+	pubKey, err := hex.DecodeString(nodeID)
+	if err != nil || len(pubKey) != nodeIDLen ||
+		(pubKey[0] != 0x02 && pubKey[0] != 0x03) {
+
+		return "", fmt.Errorf("invalid node id %q", nodeID)
+	}
+	return hex.EncodeToString(pubKey), nil
+}
+
+// parseNodeSet validates the passed node ids and returns them in canonical
+// form, sorted and without duplicates.
+func parseNodeSet(nodeIDs []string) ([]string, error) {
+	if len(nodeIDs) == 0 {
+		return nil, fmt.Errorf("node set must not be empty")
+	}
+
+	set := make(map[string]struct{}, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		canonical, err := parseNodeID(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		set[canonical] = struct{}{}
+	}
+
+	nodes := make([]string, 0, len(set))
+	for node := range set {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// nodeSetConstraint returns a constraint adding a single caveat with the
+// given condition and set of node ids.
+func nodeSetConstraint(cond string,
+	nodeIDs []string) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(cond, &err)
+
+		nodes, err := parseNodeSet(nodeIDs)
+		if err != nil {
+			return err
+		}
+		return addCaveat(mac, cond, strings.Join(nodes, " "))
+	}
+}
+
+// ForbidNodesConstraint forbids the given nodes from appearing at any hop of
+// the route of a payment made with the macaroon.
+func ForbidNodesConstraint(nodes ...string) func(*macaroon.Macaroon) error {
+	return nodeSetConstraint(CondForbidNodes, nodes)
+}
+
+// ForbidNodesFromConstraint forbids the given nodes from appearing at any hop
+// of the route of a payment made with the macaroon, like ForbidNodesConstraint
+// does, but is meant for long deny lists. The nodes are split into several
+// forbid-nodes caveats of at most forbidNodesChunk nodes each, which are all
+// checked by ForbidNodesChecker.
+func ForbidNodesFromConstraint(nodes []string) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondForbidNodes, &err)
+
+		nodes, err := parseNodeSet(nodes)
+		if err != nil {
+			return err
+		}
+		for len(nodes) > 0 {
+			n := len(nodes)
+			if n > forbidNodesChunk {
+				n = forbidNodesChunk
+			}
+			arg := strings.Join(nodes[:n], " ")
+			err := addCaveat(mac, CondForbidNodes, arg)
+			if err != nil {
+				return err
+			}
+			nodes = nodes[n:]
+		}
+		return nil
+	}
+}
+
+// ForbidNodesChecker accepts the node ids of the route of a payment, in
+// order, and rejects it if any of them is forbidden by the macaroon. The route
+// is indexed once, so that checking a caveat only takes a lookup per node it
+// lists.
+func ForbidNodesChecker(path []string) checkers.Checker {
+	hops := make(map[string]int, len(path))
+	for i, node := range path {
+		node = strings.ToLower(node)
+		if _, ok := hops[node]; !ok {
+			hops[node] = i
+		}
+	}
+
+	return checkers.CheckerFunc{
+		Condition_: CondForbidNodes,
+		Check_: func(_, cav string) error {
+			for _, node := range strings.Fields(cav) {
+				i, ok := hops[strings.ToLower(node)]
+				if ok {
+					return fmt.Errorf("hop %d of route is "+
+						"forbidden node %s", i, path[i])
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// DestinationConstraint restricts the macaroon to payments whose final
+// recipient is one of the given nodes, without constraining the intermediate
+// hops of the route.
+func DestinationConstraint(nodes ...string) func(*macaroon.Macaroon) error {
+	return nodeSetConstraint(CondDestination, nodes)
+}
+
+// DestinationChecker accepts the node id of the final hop of the route of a
+// payment, and rejects the payment unless it's one of the destinations
+// allowed by the macaroon.
+func DestinationChecker(finalNode string) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondDestination,
+		Check_: func(_, cav string) error {
+			node, err := parseNodeID(finalNode)
+			if err != nil {
+				return fmt.Errorf("invalid destination: %v",
+					err)
+			}
+			for _, allowed := range strings.Fields(cav) {
+				if strings.ToLower(allowed) == node {
+					return nil
+				}
+			}
+			return fmt.Errorf("destination %s not allowed", node)
+		},
+	}
+}
+
+// OutgoingChannelConstraint restricts the macaroon to payments whose first hop
+// goes through the channel with the given short channel id, e.g. to drain a
+// specific channel for liquidity management.
+func OutgoingChannelConstraint(chanID uint64) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondOutgoingChannel, &err)
+
+		if chanID == 0 {
+			return fmt.Errorf("channel id must not be zero")
+		}
+		arg := strconv.FormatUint(chanID, 10)
+		return addCaveat(mac, CondOutgoingChannel, arg)
+	}
+}
+
+// OutgoingChannelChecker accepts the short channel id of the first hop of a
+// payment and rejects it if it's not the channel locked in the macaroon.
+func OutgoingChannelChecker(usedChanID uint64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondOutgoingChannel,
+		Check_: func(_, cav string) error {
+			chanID, err := strconv.ParseUint(cav, 10, 64)
+			if err != nil || chanID == 0 {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondOutgoingChannel, cav)
+			}
+			if usedChanID != chanID {
+				return fmt.Errorf("payment must leave "+
+					"through channel %d, not %d", chanID,
+					usedChanID)
+			}
+			return nil
+		},
+	}
+}
+
+// PublicChannelsOnlyConstraint restricts the macaroon to paying over routes
+// that only go through public channels.
+func PublicChannelsOnlyConstraint() func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondPublicOnly, &err)
+
+		return addCaveat(mac, CondPublicOnly, "")
+	}
+}
+
+// PublicChannelsChecker accepts whether every channel of the payment route is
+// public, as determined by the caller, and rejects the route otherwise.
+func PublicChannelsChecker(allPublic bool) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondPublicOnly,
+		Check_: func(_, cav string) error {
+			if cav != "" {
+				return fmt.Errorf("invalid public-only caveat")
+			}
+			if !allPublic {
+				return fmt.Errorf("route contains private " +
+					"channels")
+			}
+			return nil
+		},
+	}
+}
+
+// RouteScoreConstraint restricts the macaroon to paying over routes whose
+// nodes have an average trust score of at least min. Scores range from 0 to 1,
+// and min must be within (0, 1]. The average rather than the sum is used so
+// that the threshold doesn't depend on the length of the route.
+func RouteScoreConstraint(min float64) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondRouteScoreMin, &err)
+
+		// The negated comparison also rejects NaN.
+		if !(min > 0 && min <= 1) {
+			return fmt.Errorf("%s must be within (0, 1], got %v",
+				CondRouteScoreMin, min)
+		}
+		arg := strconv.FormatFloat(min, 'g', -1, 64)
+		return addCaveat(mac, CondRouteScoreMin, arg)
+	}
+}
+
+// RouteScoreChecker accepts the trust scores of the nodes of a payment route,
+// in the same order as the route, and rejects the route if their average is
+// below the minimum locked in the macaroon. An empty route has no score and is
+// always rejected.
+func RouteScoreChecker(scores []float64) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondRouteScoreMin,
+		Check_: func(_, cav string) error {
+			min, err := strconv.ParseFloat(cav, 64)
+			if err != nil || !(min > 0 && min <= 1) {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondRouteScoreMin, cav)
+			}
+			if len(scores) == 0 {
+				return fmt.Errorf("route has no scores")
+			}
+
+			var sum float64
+			for i, score := range scores {
+				if !(score >= 0 && score <= 1) {
+					return fmt.Errorf("score %v of hop %d "+
+						"out of range", score, i)
+				}
+				sum += score
+			}
+			if avg := sum / float64(len(scores)); avg < min {
+				return fmt.Errorf("route score %v is below "+
+					"%v", avg, min)
+			}
+			return nil
+		},
+	}
+}
+
+// MinOperatorsConstraint restricts the macaroon to paying over routes whose
+// nodes are run by at least n distinct operators, so that no single operator
+// controls the whole route.
+func MinOperatorsConstraint(n int) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondMinOperators, &err)
+
+		if n < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d",
+				CondMinOperators, n)
+		}
+		return addCaveat(mac, CondMinOperators, strconv.Itoa(n))
+	}
+}
+
+// MinOperatorsChecker accepts the node ids of the route of a payment along
+// with a function mapping a node to its operator, and rejects the route if
+// its nodes are run by fewer distinct operators than the macaroon requires.
+// Nodes for which operator returns an empty string have no known operator and
+// don't count towards the minimum.
+func MinOperatorsChecker(path []string,
+	operator func(node string) string) checkers.Checker {
+
+	return checkers.CheckerFunc{
+		Condition_: CondMinOperators,
+		Check_: func(_, cav string) error {
+			min, err := strconv.Atoi(cav)
+			if err != nil || min < 1 {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondMinOperators, cav)
+			}
+
+			operators := make(map[string]struct{}, len(path))
+			for _, node := range path {
+				if op := operator(node); op != "" {
+					operators[op] = struct{}{}
+				}
+			}
+			if len(operators) < min {
+				return fmt.Errorf("route has %d distinct "+
+					"operators, at least %d required",
+					len(operators), min)
+			}
+			return nil
+		},
+	}
+}
+
+// MinChannelAgeConstraint restricts the macaroon to paying over routes whose
+// channels were all confirmed at least the given number of blocks ago, which
+// keeps payments away from freshly opened and possibly flaky channels.
+func MinChannelAgeConstraint(blocks int) func(*macaroon.Macaroon) error {
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(CondMinChannelAge, &err)
+
+		if blocks < 0 {
+			return fmt.Errorf("%s must not be negative, got %d",
+				CondMinChannelAge, blocks)
+		}
+		return addCaveat(mac, CondMinChannelAge, strconv.Itoa(blocks))
+	}
+}
+
+// MinChannelAgeChecker accepts the ages, in blocks, of the channels of a
+// payment route, in the same order as the route, and rejects the route if any
+// of them is younger than the macaroon allows. An empty route is always
+// rejected.
+func MinChannelAgeChecker(ages []int) checkers.Checker {
+	return checkers.CheckerFunc{
+		Condition_: CondMinChannelAge,
+		Check_: func(_, cav string) error {
+			min, err := strconv.Atoi(cav)
+			if err != nil || min < 0 {
+				return fmt.Errorf("invalid %s caveat %q",
+					CondMinChannelAge, cav)
+			}
+			if len(ages) == 0 {
+				return fmt.Errorf("route has no channel ages")
+			}
+
+			for i, age := range ages {
+				if age >= min {
+					continue
+				}
+				return fmt.Errorf("channel of hop %d is %d "+
+					"blocks old, at least %d required", i,
+					age, min)
+			}
+			return nil
+		},
+	}
+}
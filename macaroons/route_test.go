@@ -0,0 +1,355 @@
+package macaroons
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// testNodeID returns a syntactically valid node id derived from the passed
+// index.
+func testNodeID(i int) string {
+	return fmt.Sprintf("02%064x", i)
+}
+
+// TestForbidNodesConstraint tests that a route is rejected if a forbidden
+// node appears at any hop.
+func TestForbidNodesConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+
+	badSets := [][]string{
+		nil,
+		{"02abcd"},
+		{"04" + strings.Repeat("00", 32)},
+		{testNodeID(1), "not hex"},
+	}
+	for _, set := range badSets {
+		constraint := ForbidNodesConstraint(set...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("node set %v should be rejected", set)
+		}
+	}
+
+	// Duplicates, even in a different case, collapse into one entry.
+	newMac, err := AddConstraints(mac, ForbidNodesConstraint(
+		testNodeID(2), strings.ToUpper(testNodeID(2)), testNodeID(1),
+	))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	expected := CondForbidNodes + " " + testNodeID(1) + " " + testNodeID(2)
+	if newMac.Caveats()[0].Id != expected {
+		t.Fatalf("unexpected caveat %q", newMac.Caveats()[0].Id)
+	}
+
+	tests := []struct {
+		path  []string
+		valid bool
+	}{
+		{[]string{testNodeID(3), testNodeID(4)}, true},
+		{[]string{testNodeID(3), testNodeID(2), testNodeID(4)}, false},
+		{[]string{testNodeID(1)}, false},
+		{nil, true},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, ForbidNodesChecker(test.path))
+		if test.valid && err != nil {
+			t.Fatalf("path %v rejected: %v", test.path, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("path %v accepted", test.path)
+		}
+	}
+}
+
+// TestForbidNodesFromConstraint tests that a long deny list is split into
+// several caveats, and that a node from any of them is rejected.
+func TestForbidNodesFromConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, ForbidNodesFromConstraint(nil))
+	if err == nil {
+		t.Fatalf("empty node list should be rejected")
+	}
+
+	nodes := make([]string, 500)
+	for i := range nodes {
+		nodes[i] = testNodeID(i)
+	}
+	newMac, err := AddConstraints(mac, ForbidNodesFromConstraint(nodes))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if n := len(newMac.Caveats()); n != 500/forbidNodesChunk {
+		t.Fatalf("expected %d caveats, got %d", 500/forbidNodesChunk,
+			n)
+	}
+
+	tests := []struct {
+		path  []string
+		valid bool
+	}{
+		{[]string{testNodeID(500), testNodeID(501)}, true},
+		{[]string{testNodeID(500), testNodeID(0)}, false},
+		{[]string{testNodeID(250)}, false},
+		{[]string{strings.ToUpper(testNodeID(499))}, false},
+		{nil, true},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, ForbidNodesChecker(test.path))
+		if test.valid && err != nil {
+			t.Fatalf("path %v rejected: %v", test.path, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("path %v accepted", test.path)
+		}
+	}
+}
+
+// TestPublicChannelsOnlyConstraint tests that routes are only accepted when
+// the caller reports them as going through public channels only.
+func TestPublicChannelsOnlyConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, PublicChannelsOnlyConstraint())
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if caveat := newMac.Caveats()[0].Id; caveat != CondPublicOnly {
+		t.Fatalf("unexpected caveat %q", caveat)
+	}
+
+	err = checkMacaroon(newMac, PublicChannelsChecker(true))
+	if err != nil {
+		t.Fatalf("public route rejected: %v", err)
+	}
+	err = checkMacaroon(newMac, PublicChannelsChecker(false))
+	if err == nil {
+		t.Fatalf("route with private channels accepted")
+	}
+
+	// Without the caveat, private channels are fine.
+	if err := checkMacaroon(mac, PublicChannelsChecker(false)); err != nil {
+		t.Fatalf("unrestricted macaroon rejected: %v", err)
+	}
+}
+
+// TestRouteScoreConstraint tests that routes are accepted based on the average
+// score of their nodes, and that out of range thresholds are rejected.
+func TestRouteScoreConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, min := range []float64{0, -0.5, 1.5, math.NaN()} {
+		constraint := RouteScoreConstraint(min)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("minimum score %v should be rejected", min)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, RouteScoreConstraint(0.8))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		scores []float64
+		valid  bool
+	}{
+		{[]float64{0.9, 0.8, 1}, true},
+		{[]float64{0.6, 1}, true},
+		{[]float64{0.8}, true},
+		{[]float64{0.9, 0.5}, false},
+		{[]float64{1, 1.5, 0.1}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, RouteScoreChecker(test.scores))
+		if test.valid && err != nil {
+			t.Fatalf("scores %v rejected: %v", test.scores, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("scores %v accepted", test.scores)
+		}
+	}
+}
+
+// TestDestinationConstraint tests that only payments to one of the allowed
+// final recipients are accepted, whatever their intermediate hops.
+func TestDestinationConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, nodes := range [][]string{nil, {"02abcd"}} {
+		constraint := DestinationConstraint(nodes...)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("destinations %v should be rejected", nodes)
+		}
+	}
+
+	newMac, err := AddConstraints(
+		mac, DestinationConstraint(testNodeID(1), testNodeID(2)),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		finalNode string
+		valid     bool
+	}{
+		{"customer", testNodeID(2), true},
+		{"uppercase customer", strings.ToUpper(testNodeID(1)), true},
+		{"non-customer", testNodeID(3), false},
+		{"invalid pubkey", "04" + testNodeID(1)[2:], false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, DestinationChecker(test.finalNode))
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.name)
+		}
+	}
+}
+
+// TestOutgoingChannelConstraint tests that only payments leaving through the
+// locked channel are accepted, and that malformed channel ids are rejected.
+func TestOutgoingChannelConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, OutgoingChannelConstraint(0))
+	if err == nil {
+		t.Fatalf("zero channel id should be rejected")
+	}
+
+	const chanID = math.MaxUint64 - 1
+	newMac, err := AddConstraints(mac, OutgoingChannelConstraint(chanID))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(newMac, OutgoingChannelChecker(chanID))
+	if err != nil {
+		t.Fatalf("locked channel rejected: %v", err)
+	}
+	for _, used := range []uint64{0, 1, math.MaxUint64} {
+		err := checkMacaroon(newMac, OutgoingChannelChecker(used))
+		if err == nil {
+			t.Fatalf("channel %d accepted", used)
+		}
+	}
+
+	malformed := []string{
+		"out-chan", "out-chan -1", "out-chan +5", "out-chan 0x10",
+		"out-chan 18446744073709551616", "out-chan 0",
+	}
+	for _, caveat := range malformed {
+		m := createDummyMacaroon(t)
+		if err := m.AddFirstPartyCaveat(caveat); err != nil {
+			t.Fatalf("Error adding caveat: %v", err)
+		}
+		err := checkMacaroon(m, OutgoingChannelChecker(1))
+		if err == nil {
+			t.Fatalf("malformed caveat %q accepted", caveat)
+		}
+	}
+}
+
+// TestMinOperatorsConstraint tests that routes are accepted based on the number
+// of distinct operators of their nodes.
+func TestMinOperatorsConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, n := range []int{0, -1} {
+		constraint := MinOperatorsConstraint(n)
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("minimum of %d should be rejected", n)
+		}
+	}
+
+	newMac, err := AddConstraints(mac, MinOperatorsConstraint(3))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	operators := map[string]string{
+		testNodeID(1): "acme",
+		testNodeID(2): "acme",
+		testNodeID(3): "globex",
+		testNodeID(4): "initech",
+	}
+	operator := func(node string) string {
+		return operators[node]
+	}
+
+	tests := []struct {
+		name  string
+		path  []string
+		valid bool
+	}{
+		{"distinct operators",
+			[]string{testNodeID(1), testNodeID(3), testNodeID(4)},
+			true},
+		{"shared operator",
+			[]string{testNodeID(1), testNodeID(2), testNodeID(3)},
+			false},
+		{"unknown operator",
+			[]string{testNodeID(1), testNodeID(3), testNodeID(5)},
+			false},
+		{"empty route", nil, false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(
+			newMac, MinOperatorsChecker(test.path, operator),
+		)
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.name)
+		}
+	}
+}
+
+// TestMinChannelAgeConstraint tests that routes are rejected if any of their
+// channels is younger than the minimum, and that negative minimums are
+// rejected.
+func TestMinChannelAgeConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	_, err := AddConstraints(mac, MinChannelAgeConstraint(-1))
+	if err == nil {
+		t.Fatalf("negative minimum should be rejected")
+	}
+
+	newMac, err := AddConstraints(mac, MinChannelAgeConstraint(144))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	if caveat := newMac.Caveats()[0].Id; caveat != "min-chan-age 144" {
+		t.Fatalf("unexpected caveat %q", caveat)
+	}
+
+	tests := []struct {
+		ages  []int
+		valid bool
+	}{
+		{[]int{1000, 144, 5000}, true},
+		{[]int{144}, true},
+		{[]int{1000, 143, 5000}, false},
+		{[]int{6}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		err := checkMacaroon(newMac, MinChannelAgeChecker(test.ages))
+		if test.valid && err != nil {
+			t.Fatalf("ages %v rejected: %v", test.ages, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("ages %v accepted", test.ages)
+		}
+	}
+
+	// A minimum of zero accepts channels of any age.
+	newMac, err = AddConstraints(mac, MinChannelAgeConstraint(0))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	err = checkMacaroon(newMac, MinChannelAgeChecker([]int{0, 3}))
+	if err != nil {
+		t.Fatalf("new channels rejected: %v", err)
+	}
+}
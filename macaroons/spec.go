@@ -0,0 +1,266 @@
+package macaroons
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+const (
+	// specSeparator separates the individual predicates of a constraint
+	// spec.
+	specSeparator = ";"
+
+	// specListSeparator separates the elements of a predicate value that
+	// takes a list, such as the operations of an allow predicate.
+	specListSeparator = ","
+
+	// specRawKey is the key of a predicate whose value is added to the
+	// macaroon verbatim as a caveat condition. It allows caveats without a
+	// dedicated key to survive a round trip through a spec.
+	specRawKey = "raw"
+)
+
+// specVarPattern matches the ${VAR} placeholders expanded by WithSpecVars.
+var specVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// specConfig holds the settings of ParseConstraintSpec changed by its options.
+type specConfig struct {
+	vars map[string]string
+}
+
+// SpecOption changes how ParseConstraintSpec parses a spec.
+type SpecOption func(*specConfig)
+
+// WithSpecVars makes ParseConstraintSpec expand ${VAR} placeholders in the
+// values of a spec from the passed variables, e.g. "ip=${NODE_IP}" for
+// templated configs. Only the passed variables are used, never the process
+// environment, and a placeholder naming an unknown variable is an error.
+// Expanded values aren't expanded again.
+func WithSpecVars(vars map[string]string) SpecOption {
+	return func(cfg *specConfig) {
+		cfg.vars = vars
+	}
+}
+
+// expandSpecVars replaces the ${VAR} placeholders in the value with the
+// matching variables.
+func expandSpecVars(value string, vars map[string]string) (string, error) {
+	var unresolved []string
+	expanded := specVarPattern.ReplaceAllStringFunc(value,
+		func(placeholder string) string {
+			name := placeholder[2 : len(placeholder)-1]
+			v, ok := vars[name]
+			if !ok {
+				unresolved = append(unresolved, name)
+				return placeholder
+			}
+			return v
+		},
+	)
+	if len(unresolved) != 0 {
+		return "", fmt.Errorf("unresolved placeholders %s in %q",
+			strings.Join(unresolved, ", "), value)
+	}
+	if strings.Contains(specVarPattern.ReplaceAllString(value, ""), "${") {
+		return "", fmt.Errorf("unterminated placeholder in %q", value)
+	}
+	return expanded, nil
+}
+
+// specParsers maps every key understood by ParseConstraintSpec to the
+// function which turns the key's value into a constraint. A constraint kind
+// is made available to config-driven deployments by adding an entry here.
+var specParsers = map[string]func(value string) (Constraint, error){
+	"allow": func(value string) (Constraint, error) {
+		ops, err := parseSpecList(value)
+		if err != nil {
+			return nil, err
+		}
+		return AllowConstraint(ops...), nil
+	},
+	"timeout": func(value string) (Constraint, error) {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q", value)
+		}
+		return TimeoutConstraint(seconds), nil
+	},
+	"expiry": func(value string) (Constraint, error) {
+		expiry, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", value)
+		}
+		return func(mac *macaroon.Macaroon) (err error) {
+			defer tagCondition(checkers.CondTimeBefore, &err)
+
+			caveat := checkers.TimeBeforeCaveat(expiry)
+			return mac.AddFirstPartyCaveat(caveat.Condition)
+		}, nil
+	},
+	"ip": func(value string) (Constraint, error) {
+		return IPLockConstraint(value), nil
+	},
+	CondClientCert: func(value string) (Constraint, error) {
+		return ClientCertConstraint(value), nil
+	},
+	CondMaxChannelCapacity: func(value string) (Constraint, error) {
+		sat, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capacity %q", value)
+		}
+		return MaxChannelCapacityConstraint(sat), nil
+	},
+	specRawKey: func(value string) (Constraint, error) {
+		// Raw caveats are tagged with their own condition, if it
+		// parses, rather than as raw ones.
+		cond, _, _ := parseCaveat(value)
+		return func(mac *macaroon.Macaroon) (err error) {
+			defer tagCondition(cond, &err)
+
+			return mac.AddFirstPartyCaveat(value)
+		}, nil
+	},
+}
+
+// specDumpers maps caveat conditions to the function which turns the
+// caveat's argument back into the value of the corresponding spec key. Each
+// entry must be the inverse of the matching entry in specParsers.
+var specDumpers = map[string]struct {
+	key  string
+	dump func(arg string) (string, error)
+}{
+	checkers.CondAllow: {"allow", func(arg string) (string, error) {
+		ops := strings.Fields(arg)
+		for _, op := range ops {
+			if strings.Contains(op, specListSeparator) {
+				return "", fmt.Errorf("operation %q can't be "+
+					"expressed in a spec", op)
+			}
+		}
+		return strings.Join(ops, specListSeparator), nil
+	}},
+	checkers.CondTimeBefore:   {"expiry", dumpVerbatim},
+	checkers.CondClientIPAddr: {"ip", dumpVerbatim},
+	CondClientIPRange:         {"ip", dumpVerbatim},
+	CondClientCert:            {CondClientCert, dumpVerbatim},
+	CondMaxChannelCapacity:    {CondMaxChannelCapacity, dumpVerbatim},
+}
+
+// dumpVerbatim is used for caveats whose argument is already a valid spec
+// value.
+func dumpVerbatim(arg string) (string, error) {
+	return arg, nil
+}
+
+// parseSpecList splits a list value of a constraint spec into its elements,
+// rejecting empty ones.
+func parseSpecList(value string) ([]string, error) {
+	items := strings.Split(value, specListSeparator)
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+		if items[i] == "" {
+			return nil, fmt.Errorf("empty element in %q", value)
+		}
+	}
+	return items, nil
+}
+
+// ParseConstraintSpec parses a single-line constraint spec such as
+// "allow=GetInfo,SendPayment; timeout=3600; ip=10.0.0.1" into the
+// corresponding constraints, in the order they appear. The returned
+// constraints are meant to be passed to AddConstraints.
+func ParseConstraintSpec(spec string,
+	opts ...SpecOption) ([]Constraint, error) {
+
+	var cfg specConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var constraints []Constraint
+	for _, predicate := range strings.Split(spec, specSeparator) {
+		predicate = strings.TrimSpace(predicate)
+		if predicate == "" {
+			continue
+		}
+
+		parts := strings.SplitN(predicate, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("predicate %q is not of the "+
+				"form key=value", predicate)
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if cfg.vars != nil {
+			var err error
+			value, err = expandSpecVars(value, cfg.vars)
+			if err != nil {
+				return nil, fmt.Errorf("unable to expand "+
+					"%s: %v", key, err)
+			}
+		}
+		if value == "" {
+			return nil, fmt.Errorf("predicate %q has no value", key)
+		}
+
+		parse, ok := specParsers[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown constraint %q", key)
+		}
+		constraint, err := parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", key,
+				err)
+		}
+		constraints = append(constraints, constraint)
+	}
+
+	return constraints, nil
+}
+
+// DumpConstraintSpec reconstructs a constraint spec from the caveats of the
+// macaroon, such that passing the result to ParseConstraintSpec yields
+// constraints which add the same caveats. Caveats without a dedicated key are
+// emitted as raw predicates. An error is returned for caveats that can't be
+// expressed in a spec at all, such as third-party caveats.
+func DumpConstraintSpec(mac *macaroon.Macaroon) (string, error) {
+	var predicates []string
+	for _, caveat := range mac.Caveats() {
+		if caveat.Location != "" {
+			return "", fmt.Errorf("third-party caveat %q can't be "+
+				"expressed in a spec", caveat.Id)
+		}
+
+		cond, arg, err := parseCaveat(caveat.Id)
+		if err != nil {
+			return "", err
+		}
+
+		dumper, ok := specDumpers[cond]
+		if !ok {
+			raw := caveat.Id
+			if strings.Contains(raw, specSeparator) ||
+				raw != strings.TrimSpace(raw) {
+
+				return "", fmt.Errorf("caveat %q can't be "+
+					"expressed in a spec", raw)
+			}
+			predicates = append(predicates, specRawKey+"="+raw)
+			continue
+		}
+
+		value, err := dumper.dump(arg)
+		if err != nil {
+			return "", err
+		}
+		predicates = append(predicates, dumper.key+"="+value)
+	}
+
+	return strings.Join(predicates, specSeparator+" "), nil
+}
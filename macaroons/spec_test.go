@@ -0,0 +1,193 @@
+package macaroons
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseConstraintSpec tests that a constraint spec is turned into the
+// same caveats as the equivalent programmatic constraints.
+func TestParseConstraintSpec(t *testing.T) {
+	constraints, err := ParseConstraintSpec(
+		"allow=GetInfo, SendPayment; timeout=3600; ip=10.0.0.1;",
+	)
+	if err != nil {
+		t.Fatalf("Error parsing spec: %v", err)
+	}
+	if len(constraints) != 3 {
+		t.Fatalf("expected 3 constraints, got %d", len(constraints))
+	}
+
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, constraints...)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	caveats := newMac.Caveats()
+	if caveats[0].Id != "allow GetInfo SendPayment" {
+		t.Fatalf("unexpected allow caveat %q", caveats[0].Id)
+	}
+	if caveats[2].Id != "client-ip-addr 10.0.0.1" {
+		t.Fatalf("unexpected ip caveat %q", caveats[2].Id)
+	}
+
+	err = checkMacaroon(
+		newMac, AllowChecker("SendPayment"), TimeoutChecker(),
+		IPLockChecker("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	err = checkMacaroon(
+		newMac, AllowChecker("NewAddress"), TimeoutChecker(),
+		IPLockChecker("10.0.0.1"),
+	)
+	if err == nil {
+		t.Fatalf("operation outside of the allow list accepted")
+	}
+
+	badSpecs := []string{
+		"unknown=1",
+		"timeout",
+		"timeout=",
+		"timeout=soon",
+		"allow=GetInfo,,SendPayment",
+	}
+	for _, spec := range badSpecs {
+		if _, err := ParseConstraintSpec(spec); err == nil {
+			t.Fatalf("spec %q should be rejected", spec)
+		}
+	}
+
+	// Failures are reported with the condition of the caveat the
+	// predicate would have added, raw ones included.
+	failing := []struct {
+		spec     string
+		expected string
+	}{
+		{"ip=10.0.0.0/33", "constraint 0 (client-ip-range) failed: "},
+		{"raw=label " + strings.Repeat("x", 1<<16),
+			"constraint 0 (label) failed: "},
+	}
+	for _, test := range failing {
+		constraints, err := ParseConstraintSpec(test.spec)
+		if err != nil {
+			t.Fatalf("Error parsing spec: %v", err)
+		}
+		_, err = AddConstraints(mac, constraints...)
+		if err == nil ||
+			!strings.HasPrefix(err.Error(), test.expected) {
+
+			t.Fatalf("expected error %q, got %v", test.expected,
+				err)
+		}
+	}
+}
+
+// TestParseConstraintSpecVars tests that placeholders are expanded from the
+// passed variables only, and that unresolved ones are rejected.
+func TestParseConstraintSpecVars(t *testing.T) {
+	vars := map[string]string{
+		"NODE_IP": "10.0.0.1",
+		"OPS":     "GetInfo,SendPayment",
+		"LOOP":    "${NODE_IP}",
+	}
+	constraints, err := ParseConstraintSpec(
+		"allow=${OPS}; ip=${NODE_IP}; raw=label ${LOOP}",
+		WithSpecVars(vars),
+	)
+	if err != nil {
+		t.Fatalf("Error parsing spec: %v", err)
+	}
+	newMac, err := AddConstraints(createDummyMacaroon(t), constraints...)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	var caveats []string
+	for _, caveat := range newMac.Caveats() {
+		caveats = append(caveats, caveat.Id)
+	}
+	expected := []string{
+		"allow GetInfo SendPayment", "client-ip-addr 10.0.0.1",
+		"label ${NODE_IP}",
+	}
+	if !reflect.DeepEqual(caveats, expected) {
+		t.Fatalf("expected caveats %v, got %v", expected, caveats)
+	}
+
+	// Without the option, placeholders are kept verbatim.
+	constraints, err = ParseConstraintSpec("raw=label ${NODE_IP}")
+	if err != nil {
+		t.Fatalf("Error parsing spec: %v", err)
+	}
+	if len(constraints) != 1 {
+		t.Fatalf("expected 1 constraint, got %d", len(constraints))
+	}
+
+	badSpecs := []string{
+		"ip=${HOME}",
+		"ip=${NODE_IP",
+		"ip=${}",
+		"allow=GetInfo; ip=${NODE_IP}${MISSING}",
+	}
+	for _, spec := range badSpecs {
+		_, err := ParseConstraintSpec(spec, WithSpecVars(vars))
+		if err == nil {
+			t.Fatalf("spec %q should be rejected", spec)
+		}
+	}
+}
+
+// TestDumpConstraintSpec tests that dumping a macaroon's caveats to a spec
+// and parsing it again results in the very same caveats.
+func TestDumpConstraintSpec(t *testing.T) {
+	certHash := sha256.Sum256([]byte("client cert"))
+
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo", "SendPayment"),
+		TimeoutConstraint(3600), IPLockConstraint("10.0.0.1"),
+		ClientCertConstraint(hex.EncodeToString(certHash[:])),
+		MaxChannelCapacityConstraint(5000000),
+		IPRangeConstraint("192.168.1.0/24"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	if err := newMac.AddFirstPartyCaveat("future-caveat a b"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	spec, err := DumpConstraintSpec(newMac)
+	if err != nil {
+		t.Fatalf("Error dumping spec: %v", err)
+	}
+	if !strings.Contains(spec, "; ip=192.168.1.0/24;") {
+		t.Fatalf("IP range not dumped as an ip predicate: %q", spec)
+	}
+	constraints, err := ParseConstraintSpec(spec)
+	if err != nil {
+		t.Fatalf("Error parsing dumped spec %q: %v", spec, err)
+	}
+	roundTripMac, err := AddConstraints(mac, constraints...)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	if !reflect.DeepEqual(newMac.Caveats(), roundTripMac.Caveats()) {
+		t.Fatalf("caveats differ after round trip: %v vs %v",
+			newMac.Caveats(), roundTripMac.Caveats())
+	}
+
+	// A raw caveat that would be split apart by the parser must be
+	// refused rather than silently mangled.
+	if err := newMac.AddFirstPartyCaveat("bad;caveat"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if _, err := DumpConstraintSpec(newMac); err == nil {
+		t.Fatalf("caveat with a separator should be rejected")
+	}
+}
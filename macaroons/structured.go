@@ -0,0 +1,66 @@
+package macaroons
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+// Structured caveats carry a JSON document as their argument, encoded as
+// unpadded URL-safe base64 so that it never contains spaces:
+//
+//	<condition> <base64url(json)>
+//
+// They provide a common format for constraints needing more than a few
+// space-delimited values.
+
+// StructConstraint adds a caveat with the given condition whose argument is
+// the JSON encoding of v. The condition must be a single word, and can't be
+// one of the conditions defined by this package.
+func StructConstraint(condition string,
+	v interface{}) func(*macaroon.Macaroon) error {
+
+	return func(mac *macaroon.Macaroon) (err error) {
+		defer tagCondition(condition, &err)
+
+		if condition == "" ||
+			strings.ContainsAny(condition, " \t\n\r") {
+
+			return fmt.Errorf("invalid condition %q", condition)
+		}
+		if _, ok := knownConditions[condition]; ok {
+			return fmt.Errorf("condition %q is reserved", condition)
+		}
+
+		payload, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("unable to encode %s caveat: %v",
+				condition, err)
+		}
+		arg := base64.RawURLEncoding.EncodeToString(payload)
+		return addCaveat(mac, condition, arg)
+	}
+}
+
+// StructChecker checks the caveats with the given condition added by
+// StructConstraint, decoding their JSON document and passing it to validate.
+// The caveat is only satisfied if validate returns nil.
+func StructChecker(condition string,
+	validate func(json.RawMessage) error) checkers.Checker {
+
+	return checkers.CheckerFunc{
+		Condition_: condition,
+		Check_: func(_, cav string) error {
+			payload, err := base64.RawURLEncoding.DecodeString(cav)
+			if err != nil || !json.Valid(payload) {
+				return fmt.Errorf("invalid %s caveat",
+					condition)
+			}
+			return validate(json.RawMessage(payload))
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package macaroons
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// testPolicy is a structured policy carried by a caveat in tests.
+type testPolicy struct {
+	Hosts    []string `json:"hosts"`
+	MaxUsers int      `json:"max_users"`
+}
+
+// TestStructConstraint tests that a struct survives the encoding into a
+// caveat and that the checker's verdict on it is enforced.
+func TestStructConstraint(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	for _, cond := range []string{"", "my policy", checkers.CondAllow} {
+		constraint := StructConstraint(cond, testPolicy{})
+		if _, err := AddConstraints(mac, constraint); err == nil {
+			t.Fatalf("condition %q should be rejected", cond)
+		}
+	}
+	constraint := StructConstraint("policy", make(chan int))
+	if _, err := AddConstraints(mac, constraint); err == nil {
+		t.Fatalf("unencodable value should be rejected")
+	}
+
+	policy := testPolicy{
+		Hosts:    []string{"a.example.com", "b example/com?"},
+		MaxUsers: 3,
+	}
+	newMac, err := AddConstraints(mac, StructConstraint("policy", policy))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	var decoded testPolicy
+	checker := StructChecker("policy", func(raw json.RawMessage) error {
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return err
+		}
+		if decoded.MaxUsers < 5 {
+			return fmt.Errorf("too few users allowed")
+		}
+		return nil
+	})
+	if err := checkMacaroon(newMac, checker); err == nil {
+		t.Fatalf("policy rejected by the checker accepted")
+	}
+	if !reflect.DeepEqual(decoded, policy) {
+		t.Fatalf("expected policy %+v, got %+v", policy, decoded)
+	}
+
+	accept := StructChecker("policy", func(json.RawMessage) error {
+		return nil
+	})
+	if err := checkMacaroon(newMac, accept); err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	malformed := createDummyMacaroon(t)
+	if err := malformed.AddFirstPartyCaveat("policy e30="); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+	if err := checkMacaroon(malformed, accept); err == nil {
+		t.Fatalf("malformed caveat accepted")
+	}
+}
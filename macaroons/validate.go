@@ -0,0 +1,70 @@
+package macaroons
+
+import (
+	"fmt"
+	"net"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// ValidateConstraints applies the constraints to a scratch macaroon and looks
+// for combinations of caveats that no request can ever satisfy, e.g. an IP
+// lock outside of an IP range lock. Such a macaroon would be valid but
+// unusable, so this is meant to catch authoring mistakes before baking.
+func ValidateConstraints(cs ...Constraint) error {
+	conditions, err := constraintConditions(cs...)
+	if err != nil {
+		return err
+	}
+
+	var (
+		lockedIPs []net.IP
+		ranges    []*net.IPNet
+	)
+	for _, condition := range conditions {
+		cond, arg, err := parseCaveat(condition)
+		if err != nil {
+			continue
+		}
+
+		switch cond {
+		case checkers.CondClientIPAddr:
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return fmt.Errorf("invalid IP lock %q", arg)
+			}
+			for _, locked := range lockedIPs {
+				if !locked.Equal(ip) {
+					return fmt.Errorf("conflicting IP "+
+						"locks %v and %v", locked, ip)
+				}
+			}
+			lockedIPs = append(lockedIPs, ip)
+
+		case CondClientIPRange:
+			_, ipNet, err := net.ParseCIDR(arg)
+			if err != nil {
+				return fmt.Errorf("invalid IP range %q", arg)
+			}
+			for _, other := range ranges {
+				if !other.Contains(ipNet.IP) &&
+					!ipNet.Contains(other.IP) {
+
+					return fmt.Errorf("disjoint IP ranges "+
+						"%v and %v", other, ipNet)
+				}
+			}
+			ranges = append(ranges, ipNet)
+		}
+	}
+
+	for _, ip := range lockedIPs {
+		for _, ipNet := range ranges {
+			if !ipNet.Contains(ip) {
+				return fmt.Errorf("IP lock %v is outside "+
+					"of IP range %v", ip, ipNet)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package macaroons
+
+import (
+	"testing"
+)
+
+// TestValidateConstraints tests that contradicting IP locks are caught before
+// baking, while consistent ones pass.
+func TestValidateConstraints(t *testing.T) {
+	tests := []struct {
+		name        string
+		constraints []Constraint
+		valid       bool
+	}{
+		{
+			"unrelated constraints",
+			[]Constraint{
+				AllowConstraint("GetInfo"),
+				TimeoutConstraint(60),
+			},
+			true,
+		},
+		{
+			"IP within range",
+			[]Constraint{
+				IPLockConstraint("10.1.2.3"),
+				IPRangeConstraint("10.0.0.0/8"),
+				IPRangeConstraint("10.1.0.0/16"),
+			},
+			true,
+		},
+		{
+			"IP outside of range",
+			[]Constraint{
+				IPLockConstraint("1.2.3.4"),
+				IPRangeConstraint("10.0.0.0/8"),
+			},
+			false,
+		},
+		{
+			"IP within wildcard lock",
+			[]Constraint{
+				IPLockConstraint("10.1.2.3"),
+				IPLockConstraint("10.1.*.*"),
+			},
+			true,
+		},
+		{
+			"IP outside of wildcard lock",
+			[]Constraint{
+				IPLockConstraint("10.2.0.1"),
+				IPLockConstraint("10.1.*.*"),
+			},
+			false,
+		},
+		{
+			"conflicting IP locks",
+			[]Constraint{
+				IPLockConstraint("10.0.0.1"),
+				IPLockConstraint("10.0.0.2"),
+			},
+			false,
+		},
+		{
+			"disjoint ranges",
+			[]Constraint{
+				IPRangeConstraint("10.0.0.0/8"),
+				IPRangeConstraint("192.168.0.0/16"),
+			},
+			false,
+		},
+		{
+			"invalid range",
+			[]Constraint{IPRangeConstraint("10.0.0.0/33")},
+			false,
+		},
+	}
+	for _, test := range tests {
+		err := ValidateConstraints(test.constraints...)
+		if test.valid && err != nil {
+			t.Fatalf("%s: rejected: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s: accepted", test.name)
+		}
+	}
+}
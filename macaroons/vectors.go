@@ -0,0 +1,48 @@
+package macaroons
+
+import (
+	"fmt"
+
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+// TestVector is a recorded request along with whether a macaroon is expected
+// to authorize it, which allows codifying a permission policy as data, e.g.
+//
+//	{Name: "reads", Request: RequestContext{Method: "getinfo"}, Allow: true}
+//	{Name: "pays", Request: RequestContext{Method: "sendpayment"}}
+type TestVector struct {
+	// Name identifies the vector in reported failures.
+	Name string
+
+	// Request is the context the macaroon is verified for, as in
+	// VerifyAndInspect.
+	Request RequestContext
+
+	// Allow is whether the macaroon is expected to authorize the request.
+	Allow bool
+}
+
+// RunTestVectors verifies the macaroon against the request of each vector and
+// returns an error for every vector whose outcome doesn't match its
+// expectation, in the order of the vectors. It returns nil if all of them
+// match. This is meant for regression tests of permission policies.
+func RunTestVectors(mac *macaroon.Macaroon, rootKey []byte,
+	vectors []TestVector) []error {
+
+	var errs []error
+	for i, vector := range vectors {
+		_, err := VerifyAndInspect(mac, rootKey, vector.Request)
+		switch {
+		case vector.Allow && err != nil:
+			errs = append(errs, fmt.Errorf("vector %d (%s): "+
+				"expected %s to be allowed: %w", i, vector.Name,
+				vector.Request.Method, err))
+		case !vector.Allow && err == nil:
+			errs = append(errs, fmt.Errorf("vector %d (%s): "+
+				"expected %s to be denied", i, vector.Name,
+				vector.Request.Method))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,52 @@
+package macaroons
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestRunTestVectors tests that matching expectations pass and that every
+// mismatched one is reported.
+func TestRunTestVectors(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("getinfo"),
+		IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	vectors := []TestVector{{
+		Name: "reads info",
+		Request: RequestContext{
+			Method: "getinfo", ClientIP: "10.0.0.1",
+		},
+		Allow: true,
+	}, {
+		Name: "pays",
+		Request: RequestContext{
+			Method: "sendpayment", ClientIP: "10.0.0.1",
+		},
+	}, {
+		Name: "other host",
+		Request: RequestContext{
+			Method: "getinfo", ClientIP: "10.0.0.2",
+		},
+	}}
+	if errs := RunTestVectors(newMac, testRootKey, vectors); errs != nil {
+		t.Fatalf("unexpected failures: %v", errs)
+	}
+
+	// Flip two expectations, both of which must be reported.
+	vectors[0].Allow = false
+	vectors[2].Allow = true
+	errs := RunTestVectors(newMac, testRootKey, vectors)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 failures, got %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "reads info") ||
+		!strings.Contains(errs[1].Error(), "other host") {
+
+		t.Fatalf("unexpected failures: %v", errs)
+	}
+}
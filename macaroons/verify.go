@@ -0,0 +1,612 @@
+package macaroons
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+var (
+	// ErrCaveatUnsatisfied is wrapped by every CaveatError, so that any
+	// caveat failure reported by VerifyAll can be detected with errors.Is.
+	ErrCaveatUnsatisfied = errors.New("caveat not satisfied")
+
+	// ErrInvalidSignature is returned by VerifyAll when the signature
+	// chain of the macaroon, including any discharges, doesn't verify.
+	ErrInvalidSignature = errors.New("invalid macaroon signature")
+)
+
+// NoExpiry is the remaining validity returned by VerifyWithRemaining for a
+// macaroon without any time-before caveat.
+const NoExpiry = time.Duration(math.MaxInt64)
+
+// CaveatError is the failure of a single first-party caveat.
+type CaveatError struct {
+	// Condition is the full condition of the unsatisfied caveat.
+	Condition string
+
+	// Err is the error returned by the checker.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *CaveatError) Error() string {
+	return fmt.Sprintf("caveat %q not satisfied: %v", e.Condition, e.Err)
+}
+
+// Unwrap returns both ErrCaveatUnsatisfied and the checker error, so that
+// errors.Is and errors.As see through to either of them.
+func (e *CaveatError) Unwrap() []error {
+	return []error{ErrCaveatUnsatisfied, e.Err}
+}
+
+// RequestContext describes the request a macaroon is presented with, from
+// which the checkers needed to verify it are derived.
+type RequestContext struct {
+	// Method is the name of the operation being invoked.
+	Method string
+
+	// ClientIP is the IP address the request originates from.
+	ClientIP string
+
+	// Checkers are additional checkers for caveats that aren't covered by
+	// the method, expiry, IP and IP range checks.
+	Checkers []checkers.Checker
+
+	// Conditional are checkers that only apply to some requests, such as
+	// amount checks that only make sense for payments.
+	Conditional []ConditionalChecker
+
+	// MacaroonCheckers are checks of the macaroon as a whole, run once
+	// its caveats have been verified.
+	MacaroonCheckers []MacaroonChecker
+}
+
+// RequestPredicate reports whether a request has some property.
+type RequestPredicate func(ctx RequestContext) bool
+
+// MethodIs returns a RequestPredicate which reports whether the request
+// invokes one of the given methods.
+func MethodIs(methods ...string) RequestPredicate {
+	return func(ctx RequestContext) bool {
+		for _, method := range methods {
+			if ctx.Method == method {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ConditionalChecker is a checker that only applies to the requests
+// satisfying a predicate.
+type ConditionalChecker struct {
+	// Applies reports whether Checker applies to the request.
+	Applies RequestPredicate
+
+	// Checker checks the caveats of its condition for the requests it
+	// applies to.
+	Checker checkers.Checker
+}
+
+// When returns a ConditionalChecker which checks caveats with the passed
+// checker only for requests satisfying pred, e.g.
+//
+//	When(MethodIs("SendPayment"), MaxCLTVChecker(blocks))
+//
+// For other requests the caveats with the condition of the checker are
+// accepted without being checked, since they don't restrict them.
+func When(pred RequestPredicate, c checkers.Checker) ConditionalChecker {
+	return ConditionalChecker{Applies: pred, Checker: c}
+}
+
+// resolve returns the checker to use for the request, which is either the
+// conditional checker or one accepting every caveat with its condition.
+func (c ConditionalChecker) resolve(ctx RequestContext) checkers.Checker {
+	if c.Applies(ctx) {
+		return c.Checker
+	}
+	return checkers.CheckerFunc{
+		Condition_: c.Checker.Condition(),
+		Check_: func(_, _ string) error {
+			return nil
+		},
+	}
+}
+
+// MacaroonChecker checks a property of a macaroon as a whole rather than one
+// of its caveats, such as its identifier.
+type MacaroonChecker func(mac *macaroon.Macaroon) error
+
+// IDChecker returns a MacaroonChecker which passes the identifier of the
+// macaroon to the given predicate and fails if it returns false. This allows
+// keeping allow or deny lists of macaroons, e.g. for revocation, without
+// relying on any caveat.
+func IDChecker(valid func(id []byte) bool) MacaroonChecker {
+	return func(mac *macaroon.Macaroon) error {
+		if !valid([]byte(mac.Id())) {
+			return fmt.Errorf("macaroon id %q not valid", mac.Id())
+		}
+		return nil
+	}
+}
+
+// AllowCheckerStrict returns a MacaroonChecker which checks the allow and deny
+// caveats of the macaroon against the method like AllowChecker does. With
+// requireAllow set, it additionally fails for a macaroon without any allow
+// caveat.
+//
+// By default a macaroon without allow caveats permits every method, i.e.
+// method checks fail open. Requiring an allow caveat makes them fail closed
+// instead, so that an unrestricted macaroon permits nothing. Like any
+// MacaroonChecker it doesn't check the signature, so it complements Verify
+// rather than replacing it.
+func AllowCheckerStrict(method string, requireAllow bool) MacaroonChecker {
+	return func(mac *macaroon.Macaroon) error {
+		check := caveatChecker(AllowChecker(method))
+		haveAllow := false
+		for _, caveat := range mac.Caveats() {
+			if caveat.Location != "" {
+				continue
+			}
+			cond, _, err := parseCaveat(caveat.Id)
+			isAllow := cond == checkers.CondAllow
+			isDeny := cond == checkers.CondDeny
+			if err != nil || (!isAllow && !isDeny) {
+				continue
+			}
+
+			haveAllow = haveAllow || isAllow
+			if err := check(caveat.Id); err != nil {
+				return err
+			}
+		}
+		if requireAllow && !haveAllow {
+			return fmt.Errorf("macaroon has no allow caveat, %s "+
+				"not allowed", method)
+		}
+		return nil
+	}
+}
+
+// DangerAckChecker returns a MacaroonChecker which fails if the method is
+// dangerous, as reported by the passed predicate, and the macaroon doesn't
+// carry a danger-ack caveat added by DangerAckConstraint. Non-dangerous
+// methods are let through either way. The danger-ack caveat itself is accepted
+// by the checkers of a RequestContext.
+func DangerAckChecker(method string,
+	dangerous func(op string) bool) MacaroonChecker {
+
+	return func(mac *macaroon.Macaroon) error {
+		if !dangerous(method) {
+			return nil
+		}
+		for _, caveat := range mac.Caveats() {
+			if caveat.Location != "" {
+				continue
+			}
+			cond, arg, err := parseCaveat(caveat.Id)
+			if err == nil && cond == CondDangerAck && arg == "" {
+				return nil
+			}
+		}
+		return fmt.Errorf("dangerous method %s needs a macaroon "+
+			"acknowledging the danger", method)
+	}
+}
+
+// checkers returns every checker needed to verify a macaroon presented with
+// the request.
+func (r RequestContext) checkers() []checkers.Checker {
+	cs := []checkers.Checker{
+		AllowChecker(r.Method),
+		TimeoutChecker(),
+		IPLockChecker(r.ClientIP),
+		IPRangeChecker(r.ClientIP),
+
+		// Danger acknowledgements don't restrict the macaroon on their
+		// own, they're only looked for by DangerAckChecker.
+		checkers.CheckerFunc{
+			Condition_: CondDangerAck,
+			Check_: func(_, cav string) error {
+				if cav != "" {
+					return fmt.Errorf("invalid %s caveat",
+						CondDangerAck)
+				}
+				return nil
+			},
+		},
+	}
+	cs = append(cs, r.Checkers...)
+	for _, c := range r.Conditional {
+		cs = append(cs, c.resolve(r))
+	}
+	return cs
+}
+
+// AuditSink receives the outcome of each caveat evaluated while verifying a
+// macaroon, which allows keeping an audit trail of authorization decisions.
+type AuditSink interface {
+	// Record is called with the condition of every first-party caveat
+	// once it has been checked, along with the result of the check.
+	Record(condition string, passed bool, err error)
+}
+
+// Verify checks the signature of the macaroon against the given root key and
+// ensures that every one of its first-party caveats is satisfied by the
+// passed checkers.
+func Verify(mac *macaroon.Macaroon, rootKey []byte,
+	cs ...checkers.Checker) error {
+
+	return VerifyWithAudit(mac, rootKey, nil, cs...)
+}
+
+// Decision is the outcome of a single verification by a Verifier, as reported
+// to its DecisionLogger.
+type Decision struct {
+	// MacaroonID is the identifier of the verified macaroon.
+	MacaroonID string
+
+	// Method is the method of the request the macaroon was verified for.
+	// It's empty for verifications without a request.
+	Method string
+
+	// ClientIP is the IP address of the request the macaroon was verified
+	// for. It's empty for verifications without a request.
+	ClientIP string
+
+	// Allowed is whether the macaroon was valid.
+	Allowed bool
+
+	// FailedCaveat is the condition of the first-party caveat that wasn't
+	// satisfied. It's empty if the macaroon was allowed, or was denied
+	// for another reason, such as a bad signature.
+	FailedCaveat string
+}
+
+// DecisionLogger receives the Decision of every verification made by a
+// Verifier, whatever its outcome, e.g. to emit audit logs.
+type DecisionLogger func(Decision)
+
+// Verifier verifies macaroons against a fixed set of checkers, reporting its
+// decisions to an optional DecisionLogger. It's safe for concurrent use as
+// long as its checkers and DecisionLogger are.
+//
+// The same checkers are used for every verification, so checkers keeping
+// state across the caveats of a macaroon, such as RelativeExpiryChecker, must
+// not be passed to NewVerifier. They belong in the Checkers of the
+// RequestContext given to VerifyRequest instead, built anew for each request.
+type Verifier struct {
+	check caveatCheckerFunc
+	log   DecisionLogger
+}
+
+// NewVerifier returns a Verifier checking first-party caveats with the passed
+// checkers. Since they're fixed, it suits checkers that don't depend on the
+// request, such as TimeoutChecker or AllowChecker for a dedicated endpoint.
+func NewVerifier(cs ...checkers.Checker) *Verifier {
+	return &Verifier{check: caveatChecker(cs...)}
+}
+
+// WithDecisionLogger returns a copy of the Verifier which reports every
+// decision it makes to the passed logger.
+func (v *Verifier) WithDecisionLogger(log DecisionLogger) *Verifier {
+	return &Verifier{check: v.check, log: log}
+}
+
+// Verify checks the signature of the macaroon against the given root key and
+// ensures that every one of its first-party caveats is satisfied by the
+// checkers of the Verifier, like the package-level Verify does.
+func (v *Verifier) Verify(mac *macaroon.Macaroon, rootKey []byte) error {
+	return v.verify(mac, rootKey, v.check, RequestContext{})
+}
+
+// VerifyRequest verifies the macaroon for the given request like
+// VerifyAndInspect does, checking its caveats with the checkers of the
+// Verifier as well as those derived from the request. Caveats recognized by
+// the checkers of the Verifier are only checked by them.
+func (v *Verifier) VerifyRequest(mac *macaroon.Macaroon, rootKey []byte,
+	ctx RequestContext) error {
+
+	checkRequest := caveatChecker(ctx.checkers()...)
+	check := func(caveat string) error {
+		err := v.check(caveat)
+		if errgo.Cause(err) == checkers.ErrCaveatNotRecognized {
+			return checkRequest(caveat)
+		}
+		return err
+	}
+	return v.verify(mac, rootKey, check, ctx)
+}
+
+// verify verifies the macaroon with the passed caveat check and the macaroon
+// checkers of the request, reporting the decision to the logger if any.
+func (v *Verifier) verify(mac *macaroon.Macaroon, rootKey []byte,
+	check caveatCheckerFunc, ctx RequestContext) error {
+
+	var failed string
+	err := mac.Verify(rootKey, func(caveat string) error {
+		err := check(caveat)
+		if err != nil && failed == "" {
+			failed = caveat
+		}
+		return err
+	}, nil)
+	if err == nil {
+		for _, checkMac := range ctx.MacaroonCheckers {
+			if err = checkMac(mac); err != nil {
+				break
+			}
+		}
+	}
+
+	if v.log != nil {
+		v.log(Decision{
+			MacaroonID:   mac.Id(),
+			Method:       ctx.Method,
+			ClientIP:     ctx.ClientIP,
+			Allowed:      err == nil,
+			FailedCaveat: failed,
+		})
+	}
+	return err
+}
+
+// VerifyMultiKey verifies the macaroon like Verify does against each of the
+// given root keys in turn, succeeding as soon as one of them verifies it. This
+// allows rotating root keys without downtime, by accepting both the current
+// and the previous key while their validity overlaps. If none of the keys
+// verifies the macaroon, the errors for all of them are returned joined
+// together, in the order of the keys.
+func VerifyMultiKey(mac *macaroon.Macaroon, rootKeys [][]byte,
+	cs ...checkers.Checker) error {
+
+	if len(rootKeys) == 0 {
+		return fmt.Errorf("no root keys to verify macaroon with")
+	}
+
+	errs := make([]error, 0, len(rootKeys))
+	for i, rootKey := range rootKeys {
+		err := Verify(mac, rootKey, cs...)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("root key %d: %w", i, err))
+	}
+	return errors.Join(errs...)
+}
+
+// VerifySignature only checks the signature chain of the macaroon against the
+// given root key, accepting every first-party caveat without evaluating it.
+// The discharges of its third-party caveats, if any, must be passed along, and
+// their signatures are checked as well. This is a cheap pre-filter rejecting
+// forged macaroons before any expensive caveat checks or external lookups: a
+// macaroon passing it must still be fully verified.
+func VerifySignature(mac *macaroon.Macaroon, rootKey []byte,
+	discharges ...*macaroon.Macaroon) error {
+
+	return mac.Verify(rootKey, func(string) error { return nil },
+		discharges)
+}
+
+// VerifyWithDischarges is identical to Verify, but additionally verifies the
+// third-party caveats of the macaroon with the passed discharge macaroons,
+// which must already be bound to it. Their first-party caveats are checked
+// with the same checkers. Pass a DischargeLocationsChecker for macaroons
+// restricting their discharge locations.
+func VerifyWithDischarges(mac *macaroon.Macaroon, rootKey []byte,
+	discharges []*macaroon.Macaroon, cs ...checkers.Checker) error {
+
+	return mac.Verify(rootKey, caveatChecker(cs...), discharges)
+}
+
+// DischargeLocationsChecker checks the discharge-locations caveats of the
+// macaroon and its discharges. It rejects the macaroon if any third-party
+// caveat of either is addressed to a location that isn't allowed, or if any
+// discharge claims such a location. Locations are only checked as they're
+// claimed, since nothing signs them, see AllowedDischargeLocationsConstraint.
+func DischargeLocationsChecker(mac *macaroon.Macaroon,
+	discharges []*macaroon.Macaroon) checkers.Checker {
+
+	var locations []string
+	for _, m := range append([]*macaroon.Macaroon{mac}, discharges...) {
+		if m != mac {
+			locations = append(locations, m.Location())
+		}
+		for _, caveat := range m.Caveats() {
+			if caveat.Location != "" {
+				locations = append(locations, caveat.Location)
+			}
+		}
+	}
+
+	return checkers.CheckerFunc{
+		Condition_: CondDischargeLocations,
+		Check_: func(_, cav string) error {
+			allowed := make(map[string]struct{})
+			for _, loc := range strings.Fields(cav) {
+				allowed[loc] = struct{}{}
+			}
+			if len(allowed) == 0 {
+				return fmt.Errorf("invalid %s caveat",
+					CondDischargeLocations)
+			}
+			for _, loc := range locations {
+				if _, ok := allowed[loc]; !ok {
+					return fmt.Errorf("discharge location "+
+						"%q not allowed", loc)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// VerifyWithAudit is identical to Verify, but additionally reports every
+// evaluated caveat to the passed sink. Verification stops at the first
+// unsatisfied caveat, so caveats following it are never recorded. Note that
+// all caveats being recorded as passed doesn't imply that the macaroon is
+// valid, as the signature is only checked once all caveats have been
+// evaluated. A nil sink disables auditing.
+func VerifyWithAudit(mac *macaroon.Macaroon, rootKey []byte, sink AuditSink,
+	cs ...checkers.Checker) error {
+
+	check := caveatChecker(cs...)
+	if sink != nil {
+		checkCaveat := check
+		check = func(caveat string) error {
+			err := checkCaveat(caveat)
+			sink.Record(caveat, err == nil, err)
+			return err
+		}
+	}
+
+	return mac.Verify(rootKey, check, nil)
+}
+
+// VerifyWithTimeout is identical to Verify, but gives up as soon as the
+// passed context is done, returning the context's error. This guards against
+// checkers that block, such as ones calling out to a remote service. Note
+// that an abandoned verification keeps running in the background until its
+// checkers return.
+func VerifyWithTimeout(ctx context.Context, mac *macaroon.Macaroon,
+	rootKey []byte, cs ...checkers.Checker) error {
+
+	// The channel is buffered so that an abandoned verification can still
+	// deliver its result and exit.
+	result := make(chan error, 1)
+	go func() {
+		result <- Verify(mac, rootKey, cs...)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// VerifyAndInspect verifies the macaroon for the given request and, if it's
+// valid, returns its authorization scope. This spares callers enforcing
+// further application-level policies a second pass over the caveats.
+func VerifyAndInspect(mac *macaroon.Macaroon, rootKey []byte,
+	ctx RequestContext) (Inspection, error) {
+
+	if err := Verify(mac, rootKey, ctx.checkers()...); err != nil {
+		return Inspection{}, err
+	}
+	for _, check := range ctx.MacaroonCheckers {
+		if err := check(mac); err != nil {
+			return Inspection{}, err
+		}
+	}
+	return Inspect(mac), nil
+}
+
+// VerifyWithRemaining verifies the macaroon for the given request like
+// VerifyAndInspect does and, if it's valid, returns how long it remains valid
+// until its earliest expiry, whether from a time-before caveat or an issued-at
+// and ttl pair, or NoExpiry if it has none. This
+// allows clients to refresh their macaroon ahead of its expiry.
+func VerifyWithRemaining(mac *macaroon.Macaroon, rootKey []byte,
+	ctx RequestContext) (time.Duration, error) {
+
+	inspection, err := VerifyAndInspect(mac, rootKey, ctx)
+	if err != nil {
+		return 0, err
+	}
+	if inspection.Expiry == nil {
+		return NoExpiry, nil
+	}
+	return inspection.Expiry.Sub(now()), nil
+}
+
+// VerifyPartial checks the signature of the macaroon like Verify does, but
+// only enforces the first-party caveats whose condition is one of the given
+// conditions, such as "client-ip-addr". Every other caveat is let through
+// without being checked at all.
+//
+// This is meant for split-trust deployments, e.g. a gateway checking the
+// client IP and expiry while the backend checks the allowed operations. It is
+// only safe if every caveat skipped here is enforced somewhere else, as the
+// macaroon is otherwise far more powerful than intended.
+func VerifyPartial(mac *macaroon.Macaroon, rootKey []byte, conditions []string,
+	cs ...checkers.Checker) error {
+
+	enforced := make(map[string]struct{}, len(conditions))
+	for _, cond := range conditions {
+		enforced[cond] = struct{}{}
+	}
+
+	check := caveatChecker(cs...)
+	return mac.Verify(rootKey, func(caveat string) error {
+		// A caveat we can't parse might be any kind of caveat, so it
+		// can't be assumed to be enforced elsewhere.
+		cond, _, err := parseCaveat(caveat)
+		if err != nil {
+			return err
+		}
+		if _, ok := enforced[cond]; !ok {
+			return nil
+		}
+		return check(caveat)
+	}, nil)
+}
+
+// VerifyAll is identical to Verify, but evaluates every first-party caveat
+// instead of stopping at the first unsatisfied one. All failures are returned
+// joined together into a single error: a *CaveatError for each unsatisfied
+// caveat, in the order of the caveats, followed by one wrapping
+// ErrInvalidSignature if the signature doesn't verify. Reporting every
+// failure at once is meant for diagnostics, verification isn't any stricter.
+func VerifyAll(mac *macaroon.Macaroon, rootKey []byte,
+	cs ...checkers.Checker) error {
+
+	var errs []error
+	check := caveatChecker(cs...)
+	err := mac.Verify(rootKey, func(caveat string) error {
+		if err := check(caveat); err != nil {
+			errs = append(errs, &CaveatError{caveat, err})
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%w: %v", ErrInvalidSignature,
+			err))
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyLenient is identical to Verify, except that first-party caveats with
+// a condition none of the checkers recognize are treated as satisfied rather
+// than failing verification. Caveats that can't be parsed at all still fail.
+//
+// WARNING: this weakens every macaroon verified with it. A caveat added by a
+// newer version to restrict the macaroon, or by a holder attenuating it, is
+// silently ignored if this server doesn't know its condition, so the
+// macaroon is accepted with more authority than it was meant to carry. It's
+// only intended to bridge rolling upgrades, and should never be the default.
+func VerifyLenient(mac *macaroon.Macaroon, rootKey []byte,
+	cs ...checkers.Checker) error {
+
+	check := caveatChecker(cs...)
+	return mac.Verify(rootKey, func(caveat string) error {
+		if _, _, err := parseCaveat(caveat); err != nil {
+			return err
+		}
+		err := check(caveat)
+		if errgo.Cause(err) == checkers.ErrCaveatNotRecognized {
+			return nil
+		}
+		return err
+	}, nil)
+}
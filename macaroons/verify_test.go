@@ -0,0 +1,948 @@
+package macaroons
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	macaroon "gopkg.in/macaroon.v1"
+)
+
+// auditRecord is a single caveat evaluation captured by captureSink.
+type auditRecord struct {
+	condition string
+	passed    bool
+}
+
+// captureSink is an AuditSink which keeps every record in memory.
+type captureSink struct {
+	records []auditRecord
+}
+
+// Record implements the AuditSink interface.
+func (c *captureSink) Record(condition string, passed bool, err error) {
+	c.records = append(c.records, auditRecord{condition, passed})
+}
+
+// TestVerifyWithAudit tests that every evaluated caveat is reported to the
+// audit sink together with its outcome.
+func TestVerifyWithAudit(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	sink := &captureSink{}
+	err = VerifyWithAudit(
+		newMac, testRootKey, sink, AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	expected := []auditRecord{
+		{"allow GetInfo", true},
+		{"client-ip-addr 10.0.0.1", true},
+	}
+	if len(sink.records) != len(expected) {
+		t.Fatalf("expected %d records, got %v", len(expected),
+			sink.records)
+	}
+	for i := range expected {
+		if sink.records[i] != expected[i] {
+			t.Fatalf("expected record %v, got %v", expected[i],
+				sink.records[i])
+		}
+	}
+
+	sink = &captureSink{}
+	err = VerifyWithAudit(
+		newMac, testRootKey, sink, AllowChecker("NewAddress"),
+		IPLockChecker("10.0.0.1"),
+	)
+	if err == nil {
+		t.Fatalf("operation outside of the allow list accepted")
+	}
+	if len(sink.records) != 1 || sink.records[0].passed {
+		t.Fatalf("expected a single failed record, got %v",
+			sink.records)
+	}
+
+	// A nil sink must simply disable auditing.
+	err = VerifyWithAudit(
+		newMac, testRootKey, nil, AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+}
+
+// TestVerifyWithTimeout tests that verification is abandoned once the context
+// expires while a checker is still busy.
+func TestVerifyWithTimeout(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac, AccountConstraint("savings"))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	slowChecker := checkers.CheckerFunc{
+		Condition_: CondAccount,
+		Check_: func(_, _ string) error {
+			<-release
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 50*time.Millisecond,
+	)
+	defer cancel()
+	err = VerifyWithTimeout(ctx, newMac, testRootKey, slowChecker)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+
+	// A verification finishing in time returns its own result.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = VerifyWithTimeout(
+		ctx, newMac, testRootKey, AccountChecker("savings"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	err = VerifyWithTimeout(
+		ctx, newMac, testRootKey, AccountChecker("default"),
+	)
+	if err == nil {
+		t.Fatalf("mismatching account accepted")
+	}
+}
+
+// TestVerifyAndInspect tests that the scope of a valid macaroon is returned
+// along with its verification, and that an invalid one yields no scope.
+func TestVerifyAndInspect(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo", "OpenChannel", "SendPayment"),
+		AllowConstraint("OpenChannel", "GetInfo"),
+		TimeoutConstraint(600), TimeoutConstraint(60),
+		MaxChannelCapacityConstraint(5000000),
+		MaxChannelCapacityConstraint(1000000),
+		MinConfsConstraint(6), MinConfsConstraint(1),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	ctx := RequestContext{
+		Method:   "OpenChannel",
+		ClientIP: "10.0.0.1",
+		Checkers: []checkers.Checker{
+			MaxChannelCapacityChecker(500000),
+			MinConfsChecker(6),
+		},
+	}
+	inspection, err := VerifyAndInspect(newMac, testRootKey, ctx)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	expectedOps := []string{"GetInfo", "OpenChannel"}
+	if !reflect.DeepEqual(inspection.AllowedOps, expectedOps) {
+		t.Fatalf("expected allowed ops %v, got %v", expectedOps,
+			inspection.AllowedOps)
+	}
+	if inspection.Expiry == nil ||
+		time.Until(*inspection.Expiry) > time.Minute {
+
+		t.Fatalf("expected earliest expiry, got %v", inspection.Expiry)
+	}
+	expectedLimits := map[string]int64{
+		CondMaxChannelCapacity: 1000000,
+		CondMinConfs:           6,
+	}
+	if !reflect.DeepEqual(inspection.Limits, expectedLimits) {
+		t.Fatalf("expected limits %v, got %v", expectedLimits,
+			inspection.Limits)
+	}
+
+	ctx.Method = "SendPayment"
+	inspection, err = VerifyAndInspect(newMac, testRootKey, ctx)
+	if err == nil {
+		t.Fatalf("operation outside of the allow list accepted")
+	}
+	if inspection.Caveats != nil {
+		t.Fatalf("scope returned for an invalid macaroon")
+	}
+}
+
+// TestWhen tests that conditional checkers only check their caveats for the
+// requests they apply to, and accept them for others.
+func TestWhen(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(mac,
+		AllowConstraint("GetInfo", "SendPayment"),
+		MaxCLTVConstraint(144),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		blocks int
+		valid  bool
+	}{
+		{"GetInfo", 0, true},
+		{"GetInfo", 1000, true},
+		{"SendPayment", 144, true},
+		{"SendPayment", 145, false},
+		{"SendPayment", 0, true},
+	}
+	verifier := NewVerifier()
+	for _, test := range tests {
+		ctx := RequestContext{
+			Method: test.method,
+			Conditional: []ConditionalChecker{
+				When(
+					MethodIs("SendPayment", "SendToRoute"),
+					MaxCLTVChecker(test.blocks),
+				),
+			},
+		}
+		err := verifier.VerifyRequest(newMac, testRootKey, ctx)
+		if test.valid && err != nil {
+			t.Fatalf("%s with %d blocks rejected: %v", test.method,
+				test.blocks, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s with %d blocks accepted", test.method,
+				test.blocks)
+		}
+	}
+
+	// Without a conditional checker, the caveat isn't recognized.
+	ctx := RequestContext{Method: "GetInfo"}
+	if err := verifier.VerifyRequest(newMac, testRootKey, ctx); err == nil {
+		t.Fatalf("unrecognized caveat accepted")
+	}
+}
+
+// TestVerifyWithRemaining tests that the time left until the earliest expiry
+// is returned for a valid macaroon, and NoExpiry for one that never expires.
+func TestVerifyWithRemaining(t *testing.T) {
+	start := time.Date(2017, 10, 9, 12, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(fixedClock(start)))
+
+	mac := createDummyMacaroon(t)
+	ctx := RequestContext{Method: "GetInfo"}
+	remaining, err := VerifyWithRemaining(mac, testRootKey, ctx)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	if remaining != NoExpiry {
+		t.Fatalf("expected no expiry, got %v", remaining)
+	}
+
+	newMac, err := AddConstraints(
+		mac, TimeoutConstraint(3600), TimeoutConstraint(600),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	SetClock(fixedClock(start.Add(time.Minute)))
+	remaining, err = VerifyWithRemaining(newMac, testRootKey, ctx)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	if remaining != 9*time.Minute {
+		t.Fatalf("expected 9m remaining, got %v", remaining)
+	}
+
+	SetClock(fixedClock(start.Add(time.Hour)))
+	if _, err := VerifyWithRemaining(newMac, testRootKey, ctx); err == nil {
+		t.Fatalf("expired macaroon verified")
+	}
+
+	// An issued-at and ttl pair expires the macaroon like a time-before
+	// caveat does, and the earliest of both kinds is reported.
+	SetClock(fixedClock(start))
+	relMac, err := AddConstraints(
+		mac, RelativeExpiryConstraint(30*time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	SetClock(fixedClock(start.Add(10 * time.Minute)))
+	relCtx := RequestContext{
+		Method: "GetInfo",
+		Checkers: []checkers.Checker{
+			RelativeExpiryChecker(start.Add(10 * time.Minute)),
+		},
+	}
+	remaining, err = VerifyWithRemaining(relMac, testRootKey, relCtx)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	if remaining != 20*time.Minute {
+		t.Fatalf("expected 20m remaining, got %v", remaining)
+	}
+
+	bothMac, err := AddConstraints(relMac, TimeoutConstraint(300))
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+	relCtx.Checkers = []checkers.Checker{
+		RelativeExpiryChecker(start.Add(10 * time.Minute)),
+	}
+	remaining, err = VerifyWithRemaining(bothMac, testRootKey, relCtx)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	if remaining != 5*time.Minute {
+		t.Fatalf("expected 5m remaining, got %v", remaining)
+	}
+}
+
+// TestAllowCheckerStrict tests that a macaroon without allow caveats permits
+// every method unless allow caveats are required, and that allow and deny
+// caveats are enforced either way.
+func TestAllowCheckerStrict(t *testing.T) {
+	unrestricted := createDummyMacaroon(t)
+	restricted, err := AddConstraints(
+		unrestricted, AllowConstraint("GetInfo", "ListPeers"),
+		func(mac *macaroon.Macaroon) error {
+			caveat := checkers.DenyCaveat("ListPeers")
+			return mac.AddFirstPartyCaveat(caveat.Condition)
+		},
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	tests := []struct {
+		mac          *macaroon.Macaroon
+		method       string
+		requireAllow bool
+		valid        bool
+	}{
+		{unrestricted, "SendPayment", false, true},
+		{unrestricted, "SendPayment", true, false},
+		{restricted, "GetInfo", false, true},
+		{restricted, "GetInfo", true, true},
+		{restricted, "ListPeers", true, false},
+		{restricted, "SendPayment", false, false},
+	}
+	for i, test := range tests {
+		check := AllowCheckerStrict(test.method, test.requireAllow)
+		err := check(test.mac)
+		if test.valid && err != nil {
+			t.Fatalf("test %d: %s rejected: %v", i, test.method,
+				err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("test %d: %s accepted", i, test.method)
+		}
+	}
+}
+
+// TestDangerAckChecker tests that dangerous methods are only allowed with a
+// macaroon acknowledging the danger, while other methods are always allowed.
+func TestDangerAckChecker(t *testing.T) {
+	dangerous := func(op string) bool {
+		return op == "closechannel"
+	}
+	unacked := createDummyMacaroon(t)
+	acked, err := AddConstraints(unacked, DangerAckConstraint())
+	if err != nil {
+		t.Fatalf("Error adding constraint: %v", err)
+	}
+
+	tests := []struct {
+		mac    *macaroon.Macaroon
+		method string
+		valid  bool
+	}{
+		{unacked, "getinfo", true},
+		{unacked, "closechannel", false},
+		{acked, "getinfo", true},
+		{acked, "closechannel", true},
+	}
+	for i, test := range tests {
+		ctx := RequestContext{
+			Method: test.method,
+			MacaroonCheckers: []MacaroonChecker{
+				DangerAckChecker(test.method, dangerous),
+			},
+		}
+		_, err := VerifyAndInspect(test.mac, testRootKey, ctx)
+		if test.valid && err != nil {
+			t.Fatalf("test %d: %s rejected: %v", i, test.method,
+				err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("test %d: %s accepted", i, test.method)
+		}
+	}
+}
+
+// TestVerifySignature tests that only the signature of a macaroon is checked,
+// whatever its caveats.
+func TestVerifySignature(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	if err := newMac.AddFirstPartyCaveat("future-caveat"); err != nil {
+		t.Fatalf("Error adding caveat: %v", err)
+	}
+
+	if err := VerifySignature(newMac, testRootKey); err != nil {
+		t.Fatalf("intact macaroon rejected: %v", err)
+	}
+	if err := VerifySignature(newMac, []byte("wrong key")); err == nil {
+		t.Fatalf("macaroon accepted with the wrong root key")
+	}
+
+	// Swapping a caveat for a broader one breaks the signature.
+	macBytes, err := newMac.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error serializing macaroon: %v", err)
+	}
+	tampered := &macaroon.Macaroon{}
+	macBytes = bytes.Replace(
+		macBytes, []byte("allow GetInfo"), []byte("allow SendPay"), 1,
+	)
+	err = tampered.UnmarshalBinary(macBytes)
+	if err != nil {
+		t.Fatalf("Error deserializing macaroon: %v", err)
+	}
+	if err := VerifySignature(tampered, testRootKey); err == nil {
+		t.Fatalf("tampered macaroon accepted")
+	}
+}
+
+// TestVerifyPartial tests that only the selected kinds of caveats are
+// enforced, while the signature is still checked.
+func TestVerifyPartial(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), IPLockConstraint("10.0.0.1"),
+		TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	gateway := []string{"client-ip-addr", "time-before"}
+
+	// The gateway has no idea about the method, yet the macaroon passes.
+	err = VerifyPartial(
+		newMac, testRootKey, gateway, IPLockChecker("10.0.0.1"),
+		TimeoutChecker(),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	err = VerifyPartial(
+		newMac, testRootKey, gateway, IPLockChecker("10.0.0.2"),
+		TimeoutChecker(),
+	)
+	if err == nil {
+		t.Fatalf("mismatching IP accepted")
+	}
+
+	// The backend in turn only checks the allowed operations.
+	backend := []string{"allow"}
+	err = VerifyPartial(
+		newMac, testRootKey, backend, AllowChecker("GetInfo"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	err = VerifyPartial(
+		newMac, testRootKey, backend, AllowChecker("SendPayment"),
+	)
+	if err == nil {
+		t.Fatalf("operation outside of the allow list accepted")
+	}
+
+	// Skipping caveats must not skip the signature check.
+	err = VerifyPartial(
+		newMac, []byte("wrong key"), backend, AllowChecker("GetInfo"),
+	)
+	if err == nil {
+		t.Fatalf("macaroon accepted with the wrong root key")
+	}
+}
+
+// TestVerifyAll tests that every unsatisfied caveat is reported, and that
+// the individual failures can be told apart in the joined error.
+func TestVerifyAll(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), IPLockConstraint("10.0.0.1"),
+		AccountConstraint("savings"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	err = VerifyAll(
+		newMac, testRootKey, AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.1"), AccountChecker("savings"),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	err = VerifyAll(
+		newMac, testRootKey, AllowChecker("SendPayment"),
+		IPLockChecker("10.0.0.1"), AccountChecker("default"),
+	)
+	if !errors.Is(err, ErrCaveatUnsatisfied) {
+		t.Fatalf("expected unsatisfied caveats, got %v", err)
+	}
+	if errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("signature reported as invalid: %v", err)
+	}
+	var failed []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var caveatErr *CaveatError
+		if !errors.As(err, &caveatErr) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		failed = append(failed, caveatErr.Condition)
+	}
+	expected := []string{"allow GetInfo", "account savings"}
+	if !reflect.DeepEqual(failed, expected) {
+		t.Fatalf("expected failures %v, got %v", expected, failed)
+	}
+
+	// A bad signature is reported alongside the caveat failures.
+	err = VerifyAll(
+		newMac, []byte("wrong key"), AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.2"), AccountChecker("savings"),
+	)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+	if !errors.Is(err, ErrCaveatUnsatisfied) {
+		t.Fatalf("expected unsatisfied caveat, got %v", err)
+	}
+}
+
+// TestVerifyLenient tests that caveats with unknown conditions only pass under
+// lenient verification, while known caveats are enforced as usual.
+func TestVerifyLenient(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	future := func(mac *macaroon.Macaroon) error {
+		return mac.AddFirstPartyCaveat("geo-fence eu")
+	}
+	newMac, err := AddConstraints(mac, AllowConstraint("GetInfo"), future)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	err = Verify(newMac, testRootKey, AllowChecker("GetInfo"))
+	if err == nil {
+		t.Fatalf("unknown caveat accepted under strict verification")
+	}
+	err = VerifyLenient(newMac, testRootKey, AllowChecker("GetInfo"))
+	if err != nil {
+		t.Fatalf("unknown caveat rejected under lenient "+
+			"verification: %v", err)
+	}
+
+	err = VerifyLenient(newMac, testRootKey, AllowChecker("SendPayment"))
+	if err == nil {
+		t.Fatalf("known caveat not enforced under lenient " +
+			"verification")
+	}
+	err = VerifyLenient(newMac, []byte("wrong key"),
+		AllowChecker("GetInfo"))
+	if err == nil {
+		t.Fatalf("macaroon accepted with the wrong root key")
+	}
+
+	// An unknown condition nested in a composite caveat must not get the
+	// known conditions next to it skipped as well.
+	past := checkers.TimeBeforeCaveat(time.Now().Add(-time.Hour))
+	composite := func(mac *macaroon.Macaroon) error {
+		return mac.AddFirstPartyCaveat(CondAnd + " " +
+			url.QueryEscape("geo-fence eu") + " " +
+			url.QueryEscape(past.Condition))
+	}
+	newMac, err = AddConstraints(mac, AllowConstraint("GetInfo"),
+		composite)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	err = VerifyLenient(newMac, testRootKey, AllowChecker("GetInfo"),
+		AndChecker(TimeoutChecker()))
+	if err == nil {
+		t.Fatalf("expired composite caveat accepted under lenient " +
+			"verification")
+	}
+}
+
+// TestVerifyPaddedCaveats tests that caveats padded with whitespace, as left
+// behind by some other libraries, are still checked and inspected properly.
+func TestVerifyPaddedCaveats(t *testing.T) {
+	mac := createDummyMacaroon(t)
+	padded := []string{
+		" allow GetInfo ",
+		"client-ip-addr  10.0.0.1\t",
+		"or  account+a+ nonce+n1\n",
+	}
+	for _, caveat := range padded {
+		if err := mac.AddFirstPartyCaveat(caveat); err != nil {
+			t.Fatalf("Error adding caveat: %v", err)
+		}
+	}
+
+	err := Verify(
+		mac, testRootKey, AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.1"), OrChecker(AccountChecker("a")),
+	)
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	err = Verify(
+		mac, testRootKey, AllowChecker("GetInfo"),
+		IPLockChecker("10.0.0.2"), OrChecker(AccountChecker("a")),
+	)
+	if err == nil {
+		t.Fatalf("mismatching IP accepted")
+	}
+
+	expected := []string{"allow", "client-ip-addr", "or"}
+	for i, info := range ListCaveats(mac) {
+		if info.Err != nil || info.Kind != expected[i] {
+			t.Fatalf("expected caveat of kind %s, got %+v",
+				expected[i], info)
+		}
+	}
+	ops := Inspect(mac).AllowedOps
+	if !reflect.DeepEqual(ops, []string{"GetInfo"}) {
+		t.Fatalf("expected GetInfo to be allowed, got %v", ops)
+	}
+}
+
+// TestIDChecker tests that macaroons are accepted or rejected based on their
+// identifier alone, including when verified for a request.
+func TestIDChecker(t *testing.T) {
+	revoked := createDummyMacaroon(t)
+	allowed, err := macaroon.New(testRootKey, "otherId", testLocation)
+	if err != nil {
+		t.Fatalf("Error creating macaroon: %v", err)
+	}
+
+	checker := IDChecker(func(id []byte) bool {
+		return string(id) != testID
+	})
+	if err := checker(allowed); err != nil {
+		t.Fatalf("allowed id rejected: %v", err)
+	}
+	if err := checker(revoked); err == nil {
+		t.Fatalf("revoked id accepted")
+	}
+
+	ctx := RequestContext{
+		Method:           "GetInfo",
+		MacaroonCheckers: []MacaroonChecker{checker},
+	}
+	if _, err := VerifyAndInspect(allowed, testRootKey, ctx); err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+	if _, err := VerifyAndInspect(revoked, testRootKey, ctx); err == nil {
+		t.Fatalf("revoked macaroon verified")
+	}
+}
+
+// TestVerifyMultiKey tests that a macaroon verifies against a set of root keys
+// containing the one it was baked with, and fails against any other set.
+func TestVerifyMultiKey(t *testing.T) {
+	rootKeys := [][]byte{
+		[]byte("previous key"), []byte("current key"),
+		[]byte("next key"),
+	}
+	mac, err := macaroon.New(rootKeys[1], testID, testLocation)
+	if err != nil {
+		t.Fatalf("Error creating macaroon: %v", err)
+	}
+	newMac, err := AddConstraints(mac, AllowConstraint("GetInfo"))
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	err = VerifyMultiKey(newMac, rootKeys, AllowChecker("GetInfo"))
+	if err != nil {
+		t.Fatalf("Error verifying macaroon: %v", err)
+	}
+
+	// A valid key doesn't help with an unsatisfied caveat.
+	err = VerifyMultiKey(newMac, rootKeys, AllowChecker("SendPayment"))
+	if err == nil {
+		t.Fatalf("expected unsatisfied caveat to fail")
+	}
+
+	err = VerifyMultiKey(
+		newMac, [][]byte{rootKeys[0], rootKeys[2]},
+		AllowChecker("GetInfo"),
+	)
+	if err == nil {
+		t.Fatalf("expected verification with retired keys to fail")
+	}
+	errs := err.(interface{ Unwrap() []error }).Unwrap()
+	if len(errs) != 2 {
+		t.Fatalf("expected an error per key, got %v", err)
+	}
+
+	if err := VerifyMultiKey(newMac, nil); err == nil {
+		t.Fatalf("expected verification without keys to fail")
+	}
+}
+
+// TestVerifier tests that a Verifier enforces its checkers like Verify does,
+// across repeated verifications.
+func TestVerifier(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		TimeoutConstraint(60),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	v := NewVerifier(AllowChecker("GetInfo"), TimeoutChecker())
+	for i := 0; i < 2; i++ {
+		if err := v.Verify(newMac, testRootKey); err != nil {
+			t.Fatalf("Error verifying macaroon: %v", err)
+		}
+	}
+	if err := v.Verify(newMac, []byte("wrong key")); err == nil {
+		t.Fatalf("macaroon verified with the wrong root key")
+	}
+
+	v = NewVerifier(AllowChecker("SendPayment"), TimeoutChecker())
+	if err := v.Verify(newMac, testRootKey); err == nil {
+		t.Fatalf("disallowed method accepted")
+	}
+}
+
+// TestDecisionLogger tests that a Verifier reports a decision for allowed and
+// denied requests alike.
+func TestDecisionLogger(t *testing.T) {
+	newMac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		IPLockConstraint("10.0.0.1"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+
+	var decisions []Decision
+	v := NewVerifier(TimeoutChecker()).WithDecisionLogger(
+		func(d Decision) {
+			decisions = append(decisions, d)
+		},
+	)
+	requests := []RequestContext{
+		{Method: "GetInfo", ClientIP: "10.0.0.1"},
+		{Method: "SendPayment", ClientIP: "10.0.0.1"},
+		{Method: "GetInfo", ClientIP: "10.0.0.2"},
+	}
+	for i, req := range requests {
+		err := v.VerifyRequest(newMac, testRootKey, req)
+		if (i == 0) != (err == nil) {
+			t.Fatalf("request %d: unexpected result %v", i, err)
+		}
+	}
+	err = v.VerifyRequest(newMac, []byte("wrong key"), requests[0])
+	if err == nil {
+		t.Fatalf("macaroon verified with the wrong root key")
+	}
+
+	expected := []Decision{{
+		MacaroonID: testID, Method: "GetInfo", ClientIP: "10.0.0.1",
+		Allowed: true,
+	}, {
+		MacaroonID: testID, Method: "SendPayment", ClientIP: "10.0.0.1",
+		FailedCaveat: "allow GetInfo",
+	}, {
+		MacaroonID: testID, Method: "GetInfo", ClientIP: "10.0.0.2",
+		FailedCaveat: "client-ip-addr 10.0.0.1",
+	}, {
+		MacaroonID: testID, Method: "GetInfo", ClientIP: "10.0.0.1",
+	}}
+	if !reflect.DeepEqual(decisions, expected) {
+		t.Fatalf("expected decisions %+v, got %+v", expected,
+			decisions)
+	}
+}
+
+// benchmarkMacaroon returns a macaroon with a few caveats for the
+// verification benchmarks, along with the checkers satisfying them.
+func benchmarkMacaroon(b *testing.B) (*macaroon.Macaroon, []checkers.Checker) {
+	mac, err := macaroon.New(testRootKey, testID, testLocation)
+	if err != nil {
+		b.Fatalf("Error creating macaroon: %v", err)
+	}
+	newMac, err := AddConstraints(
+		mac, AllowConstraint("GetInfo"), TimeoutConstraint(3600),
+		AccountConstraint("savings"), MaxFeeRateConstraint(50),
+	)
+	if err != nil {
+		b.Fatalf("Error adding constraints: %v", err)
+	}
+	return newMac, []checkers.Checker{
+		AllowChecker("GetInfo"), TimeoutChecker(),
+		AccountChecker("savings"), MaxFeeRateChecker(10),
+	}
+}
+
+// BenchmarkVerify measures verification combining the checkers on every call.
+func BenchmarkVerify(b *testing.B) {
+	mac, cs := benchmarkMacaroon(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Verify(mac, testRootKey, cs...); err != nil {
+			b.Fatalf("Error verifying macaroon: %v", err)
+		}
+	}
+}
+
+// BenchmarkVerifier measures verification reusing a Verifier.
+func BenchmarkVerifier(b *testing.B) {
+	mac, cs := benchmarkMacaroon(b)
+	v := NewVerifier(cs...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := v.Verify(mac, testRootKey); err != nil {
+			b.Fatalf("Error verifying macaroon: %v", err)
+		}
+	}
+}
+
+// dischargedMacaroon returns a macaroon restricted to being discharged at
+// "https://auth" which carries a third-party caveat at caveatLoc, along with
+// a bound discharge for it claiming dischargeLoc.
+func dischargedMacaroon(t *testing.T, caveatLoc,
+	dischargeLoc string) (*macaroon.Macaroon, []*macaroon.Macaroon) {
+
+	mac, err := AddConstraints(
+		createDummyMacaroon(t), AllowConstraint("GetInfo"),
+		AllowedDischargeLocationsConstraint("https://auth"),
+	)
+	if err != nil {
+		t.Fatalf("Error adding constraints: %v", err)
+	}
+	caveatKey := []byte("caveat key")
+	err = mac.AddThirdPartyCaveat(caveatKey, "user is admin", caveatLoc)
+	if err != nil {
+		t.Fatalf("Error adding third-party caveat: %v", err)
+	}
+
+	discharge, err := macaroon.New(caveatKey, "user is admin", dischargeLoc)
+	if err != nil {
+		t.Fatalf("Error creating discharge: %v", err)
+	}
+	discharge.Bind(mac.Signature())
+	return mac, []*macaroon.Macaroon{discharge}
+}
+
+// TestAllowedDischargeLocations tests that macaroons are only accepted with
+// discharges from the allowed locations.
+func TestAllowedDischargeLocations(t *testing.T) {
+	badLocations := [][]string{nil, {""}, {"https://auth two"}}
+	for _, locations := range badLocations {
+		constraint := AllowedDischargeLocationsConstraint(locations...)
+		_, err := AddConstraints(createDummyMacaroon(t), constraint)
+		if err == nil {
+			t.Fatalf("locations %q should be rejected", locations)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		caveatLoc    string
+		dischargeLoc string
+		valid        bool
+	}{
+		{"allowed", "https://auth", "https://auth", true},
+		{"unlisted caveat", "https://evil", "https://evil", false},
+		{"unlisted discharge", "https://auth", "https://evil", false},
+	}
+	for _, test := range tests {
+		mac, discharges := dischargedMacaroon(
+			t, test.caveatLoc, test.dischargeLoc,
+		)
+		err := VerifyWithDischarges(
+			mac, testRootKey, discharges, AllowChecker("GetInfo"),
+			DischargeLocationsChecker(mac, discharges),
+		)
+		if test.valid && err != nil {
+			t.Fatalf("%s rejected: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s accepted", test.name)
+		}
+	}
+
+	// The restriction can't be ignored by leaving out its checker.
+	mac, discharges := dischargedMacaroon(
+		t, "https://auth", "https://auth",
+	)
+	err := VerifyWithDischarges(
+		mac, testRootKey, discharges, AllowChecker("GetInfo"),
+	)
+	if err == nil {
+		t.Fatalf("discharge locations caveat accepted without checker")
+	}
+
+	// Locations aren't covered by any signature, so a macaroon discharged
+	// at an unlisted location passes once the locations are rewritten.
+	mac, discharges = dischargedMacaroon(
+		t, "https://evil", "https://evil",
+	)
+	rewrite := func(m *macaroon.Macaroon) *macaroon.Macaroon {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Error serializing macaroon: %v", err)
+		}
+		b = bytes.Replace(
+			b, []byte("https://evil"), []byte("https://auth"), -1,
+		)
+		rewritten := &macaroon.Macaroon{}
+		if err := rewritten.UnmarshalBinary(b); err != nil {
+			t.Fatalf("Error deserializing macaroon: %v", err)
+		}
+		return rewritten
+	}
+	mac = rewrite(mac)
+	discharges = []*macaroon.Macaroon{rewrite(discharges[0])}
+	err = VerifyWithDischarges(
+		mac, testRootKey, discharges, AllowChecker("GetInfo"),
+		DischargeLocationsChecker(mac, discharges),
+	)
+	if err != nil {
+		t.Fatalf("rewritten locations rejected: %v", err)
+	}
+}